@@ -3,12 +3,16 @@ module github.com/excitedplus1s/docker-tar
 go 1.24.5
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/excitedplus1s/gfwutils v0.0.3
 	github.com/excitedplus1s/spec-go v0.0.1
 	github.com/klauspost/compress v1.17.4
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.1.1
 	github.com/schollz/progressbar/v3 v3.18.0
+	golang.org/x/net v0.42.0
+	golang.org/x/term v0.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -17,7 +21,6 @@ require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/crypto v0.40.0 // indirect
-	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
-	golang.org/x/term v0.33.0 // indirect
+	golang.org/x/text v0.27.0 // indirect
 )
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BatchImage is an image of the batch file, the empty fields fall back
+// to the command line, except the output file named after the image and its platform.
+type BatchImage struct {
+	Image        string
+	Architecture string
+	Platform     string
+	OutputFile   string
+	UserName     string
+	Password     string
+}
+
+// ReadBatchFile reads a list of images, one image per line,
+// or a YAML file when the name ends with .yaml or .yml:
+//
+//	images:
+//	  - image: nginx:1.25
+//	    arch: arm64v8
+//	    output: nginx.tar
+//	    username: user
+//	    password: secret
+//	  - redis:7
+func ReadBatchFile(name string) ([]BatchImage, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return readBatchYAML(name)
+	}
+	images, err := ReadImageList(name)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]BatchImage, len(images))
+	for i, image := range images {
+		result[i] = BatchImage{Image: image}
+	}
+	return result, nil
+}
+
+type batchYAMLFile struct {
+	Images []batchYAMLImage `yaml:"images"`
+}
+
+// batchYAMLImage is an image name or a mapping of its settings
+type batchYAMLImage struct {
+	BatchImage
+}
+
+func (image *batchYAMLImage) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Decode(&image.Image)
+	case yaml.MappingNode:
+	default:
+		return fmt.Errorf("line %d: image expected", node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		var value string
+		if err := node.Content[i+1].Decode(&value); err != nil {
+			return err
+		}
+		switch key.Value {
+		case "image":
+			image.Image = value
+		case "arch", "architecture":
+			image.Architecture = value
+		case "platform":
+			image.Platform = value
+		case "output":
+			image.OutputFile = value
+		case "username":
+			image.UserName = value
+		case "password":
+			image.Password = value
+		default:
+			return fmt.Errorf("line %d: unknown key %s", key.Line, key.Value)
+		}
+	}
+	return nil
+}
+
+func readBatchYAML(name string) ([]BatchImage, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var file batchYAMLFile
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	images := make([]BatchImage, len(file.Images))
+	for i, image := range file.Images {
+		if len(image.Image) == 0 {
+			return nil, fmt.Errorf("%s: image %d has no name", name, i+1)
+		}
+		images[i] = image.BatchImage
+	}
+	return images, nil
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The directory of the registry certificates of the Docker daemon
+const DefaultCertsDir = "/etc/docker/certs.d"
+
+// LoadCertsDir reads the TLS files of a registry in <dir>/<host[:port]>/
+// like the Docker daemon: *.crt are CA certificates, a *.cert is a client
+// certificate and the *.key of the same name its key.
+func LoadCertsDir(dir string, host string) (RegistryTLS, bool, error) {
+	var tlsConfig RegistryTLS
+	hostDir := filepath.Join(dir, host)
+	entries, err := os.ReadDir(hostDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return tlsConfig, false, nil
+	}
+	if err != nil {
+		return tlsConfig, false, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		file := filepath.Join(hostDir, name)
+		switch filepath.Ext(name) {
+		case ".crt":
+			tlsConfig.CAFiles = append(tlsConfig.CAFiles, file)
+		case ".cert":
+			keyFile := strings.TrimSuffix(file, ".cert") + ".key"
+			if _, err := os.Stat(keyFile); err != nil {
+				return tlsConfig, false, fmt.Errorf("missing key %s for client certificate %s", filepath.Base(keyFile), file)
+			}
+			tlsConfig.ClientCertificates = append(tlsConfig.ClientCertificates, ClientCertificate{file, keyFile})
+		case ".key":
+			certFile := strings.TrimSuffix(file, ".key") + ".cert"
+			if _, err := os.Stat(certFile); err != nil {
+				return tlsConfig, false, fmt.Errorf("missing client certificate %s for key %s", filepath.Base(certFile), file)
+			}
+		}
+	}
+	found := len(tlsConfig.CAFiles) > 0 || len(tlsConfig.ClientCertificates) > 0
+	return tlsConfig, found, nil
+}
+
+// merge adds the CA files and the client certificates of other
+func (tlsConfig RegistryTLS) merge(other RegistryTLS) RegistryTLS {
+	tlsConfig.SkipVerify = tlsConfig.SkipVerify || other.SkipVerify
+	tlsConfig.CAFiles = append(append([]string{}, tlsConfig.CAFiles...), other.CAFiles...)
+	tlsConfig.ClientCertificates = append(append([]ClientCertificate{}, tlsConfig.ClientCertificates...), other.ClientCertificates...)
+	return tlsConfig
+}
@@ -1,6 +1,17 @@
 package cli
 
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
 const defaultArchitecture = "amd64"
+const defaultParallel = 3
+const defaultCacheSize = 10240
+const defaultFormat = "docker"
+const defaultRetries = 3
+const defaultRetryWait = time.Second
 
 type ExperimentalFeature struct {
 	// IPv-Only,IPv6-Only or Dual
@@ -12,11 +23,29 @@ type ExperimentalFeature struct {
 type Config struct {
 	action         string
 	outputFile     string
+	format         string
 	imageInfo      string
+	images         []string
+	batchFile      string
 	username       string
 	password       string
 	architecture   string
+	platform       string
 	mirrorRegistry string
+	registries     *RegistriesConfig
+	insecure       []string
+	tls            RegistryTLS
+	certsDir       *string
+	proxyURL       *url.URL
+	registry       string
+	parallel       int
+	retries        *int
+	retryWait      time.Duration
+	rateLimitWait  bool
+	cacheDir       string
+	cacheDisabled  bool
+	cacheSize      int64
+	attestations   bool
 	experimental   *ExperimentalFeature
 }
 
@@ -36,6 +65,17 @@ func (c *Config) OutputFile() string {
 	return c.outputFile
 }
 
+func (c *Config) SetFormat(format string) {
+	c.format = format
+}
+
+func (c *Config) Format() string {
+	if len(c.format) == 0 {
+		return defaultFormat
+	}
+	return c.format
+}
+
 func (c *Config) SetImageInfo(imageInfo string) {
 	c.imageInfo = imageInfo
 }
@@ -44,6 +84,34 @@ func (c *Config) ImageInfo() string {
 	return c.imageInfo
 }
 
+func (c *Config) SetImages(images []string) {
+	c.images = images
+}
+
+// Images returns the images saved in one archive,
+// the image info is split by commas when no list is set.
+func (c *Config) Images() []string {
+	if len(c.images) > 0 {
+		return c.images
+	}
+	var result []string
+	for _, image := range strings.Split(c.imageInfo, ",") {
+		image = strings.TrimSpace(image)
+		if len(image) > 0 {
+			result = append(result, image)
+		}
+	}
+	return result
+}
+
+func (c *Config) SetBatchFile(batchFile string) {
+	c.batchFile = batchFile
+}
+
+func (c *Config) BatchFile() string {
+	return c.batchFile
+}
+
 func (c *Config) SetArchitecture(architecture string) {
 	c.architecture = architecture
 }
@@ -55,6 +123,51 @@ func (c *Config) Architecture() string {
 	return c.architecture
 }
 
+// Architectures splits a comma separated architecture list
+func (c *Config) Architectures() []string {
+	var result []string
+	for _, arch := range strings.Split(c.Architecture(), ",") {
+		arch = strings.TrimSpace(arch)
+		if len(arch) > 0 {
+			result = append(result, arch)
+		}
+	}
+	return result
+}
+
+func (c *Config) SetPlatform(platform string) {
+	c.platform = platform
+}
+
+func (c *Config) Platform() string {
+	return c.platform
+}
+
+// Platforms splits a comma separated platform list,
+// the architectures are used when no platform is set.
+func (c *Config) Platforms() []string {
+	if len(c.platform) == 0 {
+		return c.Architectures()
+	}
+	var result []string
+	for _, platform := range strings.Split(c.platform, ",") {
+		platform = strings.TrimSpace(platform)
+		if len(platform) > 0 {
+			result = append(result, platform)
+		}
+	}
+	return result
+}
+
+func (c *Config) SetRegistry(registry string) {
+	c.registry = registry
+}
+
+// Registry is the registry of login and logout
+func (c *Config) Registry() string {
+	return c.registry
+}
+
 func (c *Config) SetMirrorRegistry(mirrorRegistry string) {
 	c.mirrorRegistry = mirrorRegistry
 }
@@ -63,6 +176,220 @@ func (c *Config) MirrorRegistry() string {
 	return c.mirrorRegistry
 }
 
+// MirrorRegistries splits a comma separated mirror list, they are tried in order
+func (c *Config) MirrorRegistries() []string {
+	var result []string
+	for _, mirror := range strings.Split(c.mirrorRegistry, ",") {
+		mirror = strings.TrimSpace(mirror)
+		if len(mirror) > 0 {
+			result = append(result, mirror)
+		}
+	}
+	return result
+}
+
+func (c *Config) SetRegistriesConfig(registries *RegistriesConfig) {
+	c.registries = registries
+}
+
+// RegistryConfig returns the config of the registry[/path] reference
+func (c *Config) RegistryConfig(reference string) (*RegistryConfig, bool) {
+	if c.registries == nil {
+		return nil, false
+	}
+	return c.registries.Lookup(reference)
+}
+
+// RegistryTLS returns the TLS settings of the host[:port]: the ones of the
+// registries config and of the certs directory, and the ones of the command
+// line when the host is a registry endpoint, not the CDN a blob is
+// redirected to. The certificate of an insecure registry is not verified.
+func (c *Config) RegistryTLS(host string, endpoint bool) (RegistryTLS, bool, error) {
+	var registryTLS RegistryTLS
+	var ok bool
+	if c.registries != nil {
+		registryTLS, ok = c.registries.TLS(host)
+	}
+	if certsDir := c.CertsDir(); len(certsDir) > 0 {
+		certsTLS, found, err := LoadCertsDir(certsDir, host)
+		if err != nil {
+			return registryTLS, false, err
+		}
+		if found {
+			registryTLS, ok = registryTLS.merge(certsTLS), true
+		}
+	}
+	if endpoint && (len(c.tls.CAFiles) > 0 || len(c.tls.ClientCertificates) > 0) {
+		registryTLS, ok = registryTLS.merge(c.tls), true
+	}
+	if c.InsecureRegistry(host) {
+		registryTLS.SkipVerify = true
+		ok = true
+	}
+	return registryTLS, ok, nil
+}
+
+// AddCAFile trusts the PEM certificates of the file for the registry endpoints
+func (c *Config) AddCAFile(caFile string) {
+	c.tls.CAFiles = append(c.tls.CAFiles, caFile)
+}
+
+// SetClientCertificate presents the certificate to the registry endpoints
+// asking for one, the key is read from the certificate file when keyFile is empty.
+func (c *Config) SetClientCertificate(certFile string, keyFile string) {
+	c.tls.ClientCertificates = []ClientCertificate{{CertFile: certFile, KeyFile: keyFile}}
+}
+
+// CheckTLSFiles reports the missing files of the command line
+func (c *Config) CheckTLSFiles() error {
+	return c.tls.check()
+}
+
+func (c *Config) SetCertsDir(certsDir string) {
+	c.certsDir = &certsDir
+}
+
+// CertsDir is the directory of the <host>/ certificates, empty when disabled
+func (c *Config) CertsDir() string {
+	if c.certsDir == nil {
+		return DefaultCertsDir
+	}
+	return *c.certsDir
+}
+
+func (c *Config) AddInsecureRegistry(registry string) {
+	registry = strings.TrimSpace(registry)
+	if _, rest, ok := strings.Cut(registry, "://"); ok {
+		registry = rest
+	}
+	registry = strings.TrimSuffix(registry, "/")
+	if len(registry) > 0 {
+		c.insecure = append(c.insecure, registry)
+	}
+}
+
+func (c *Config) InsecureRegistries() []string {
+	return c.insecure
+}
+
+// InsecureRegistry tells if the registry host[:port] may be reached over
+// plain HTTP and with an unverified certificate. A registry given without
+// port matches every port of the host.
+func (c *Config) InsecureRegistry(host string) bool {
+	host = CanonicalRegistry(host)
+	hostname, _, hasPort := strings.Cut(host, ":")
+	for _, registry := range c.insecure {
+		registry = CanonicalRegistry(registry)
+		if registry == host {
+			return true
+		}
+		if hasPort && !strings.Contains(registry, ":") && registry == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// SetProxyURL sets the proxy of every request, HTTP_PROXY and HTTPS_PROXY are used when nil
+func (c *Config) SetProxyURL(proxyURL *url.URL) {
+	c.proxyURL = proxyURL
+}
+
+func (c *Config) ProxyURL() *url.URL {
+	return c.proxyURL
+}
+
+func (c *Config) SetParallel(parallel int) {
+	c.parallel = parallel
+}
+
+func (c *Config) SetRetries(retries int) {
+	c.retries = &retries
+}
+
+// Retries is the number of times a failed request is sent again
+func (c *Config) Retries() int {
+	if c.retries == nil || *c.retries < 0 {
+		return defaultRetries
+	}
+	return *c.retries
+}
+
+func (c *Config) SetRetryWait(retryWait time.Duration) {
+	c.retryWait = retryWait
+}
+
+// RetryWait is the wait before the first retry, it doubles after each retry
+func (c *Config) RetryWait() time.Duration {
+	if c.retryWait <= 0 {
+		return defaultRetryWait
+	}
+	return c.retryWait
+}
+
+func (c *Config) SetRateLimitWait(rateLimitWait bool) {
+	c.rateLimitWait = rateLimitWait
+}
+
+// RateLimitWait waits for the pull quota instead of failing on the rate limit
+func (c *Config) RateLimitWait() bool {
+	return c.rateLimitWait
+}
+
+func (c *Config) Parallel() int {
+	if c.parallel <= 0 {
+		return defaultParallel
+	}
+	return c.parallel
+}
+
+func (c *Config) SetCacheDir(cacheDir string) {
+	c.cacheDir = cacheDir
+}
+
+func (c *Config) CacheDir() string {
+	return c.cacheDir
+}
+
+func (c *Config) DisableCache() {
+	c.cacheDisabled = true
+}
+
+func (c *Config) SetAttestations(attestations bool) {
+	c.attestations = attestations
+}
+
+// Attestations tells if the provenance and SBOM attestations are saved with the image
+func (c *Config) Attestations() bool {
+	return c.attestations
+}
+
+func (c *Config) CacheDisabled() bool {
+	return c.cacheDisabled
+}
+
+// SetCacheSize sets the cache size limit in MB
+func (c *Config) SetCacheSize(cacheSize int64) {
+	c.cacheSize = cacheSize
+}
+
+func (c *Config) CacheSize() int64 {
+	if c.cacheSize <= 0 {
+		return defaultCacheSize
+	}
+	return c.cacheSize
+}
+
+// Clone returns a copy which can be changed without affecting the original
+func (c *Config) Clone() *Config {
+	clone := *c
+	if c.experimental != nil {
+		experimental := *c.experimental
+		clone.experimental = &experimental
+	}
+	return &clone
+}
+
 func (c *Config) ExperimentalEnabled() bool {
 	return c.experimental != nil
 }
@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The username a helper returns with an identity token
+const identityTokenUserName = "<token>"
+
+// The error message of the helpers for an unknown registry
+const credentialsNotFound = "credentials not found in native keychain"
+
+// credentialHelperMessage is read and written by the docker-credential-* helpers
+type credentialHelperMessage struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// runCredentialHelper runs docker-credential-<helper> <action>
+// with the input on stdin, the helpers print their errors on stdout.
+func runCredentialHelper(helper string, action string, input []byte) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String())
+		if len(message) == 0 {
+			message = strings.TrimSpace(stderr.String())
+		}
+		if len(message) == 0 {
+			message = err.Error()
+		}
+		return nil, fmt.Errorf("docker-credential-%s %s: %s", helper, action, message)
+	}
+	return stdout.Bytes(), nil
+}
+
+func credentialHelperGet(helper string, serverAddress string) (Credentials, error) {
+	out, err := runCredentialHelper(helper, "get", []byte(serverAddress))
+	if err != nil {
+		if strings.Contains(err.Error(), credentialsNotFound) {
+			return Credentials{}, nil
+		}
+		return Credentials{}, err
+	}
+	var message credentialHelperMessage
+	if err := json.Unmarshal(out, &message); err != nil {
+		return Credentials{}, fmt.Errorf("docker-credential-%s get: %v", helper, err)
+	}
+	if message.Username == identityTokenUserName {
+		return Credentials{IdentityToken: message.Secret}, nil
+	}
+	return Credentials{
+		UserName: message.Username,
+		Password: message.Secret,
+	}, nil
+}
+
+func credentialHelperStore(helper string, serverAddress string, credentials Credentials) error {
+	message := credentialHelperMessage{
+		ServerURL: serverAddress,
+		Username:  credentials.UserName,
+		Secret:    credentials.Password,
+	}
+	if len(credentials.IdentityToken) > 0 {
+		message.Username = identityTokenUserName
+		message.Secret = credentials.IdentityToken
+	}
+	input, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = runCredentialHelper(helper, "store", input)
+	return err
+}
+
+func credentialHelperErase(helper string, serverAddress string) error {
+	_, err := runCredentialHelper(helper, "erase", []byte(serverAddress))
+	if err != nil && strings.Contains(err.Error(), credentialsNotFound) {
+		return nil
+	}
+	return err
+}
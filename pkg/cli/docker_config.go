@@ -0,0 +1,314 @@
+package cli
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DockerHubServerAddress is the key of Docker Hub in config.json
+const DockerHubServerAddress = "https://index.docker.io/v1/"
+
+// DockerAuthConfig is an entry of auths in config.json
+type DockerAuthConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	Email         string `json:"email,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// Credentials of a registry, the identity token is an OAuth2
+// refresh token used instead of the password.
+type Credentials struct {
+	UserName      string
+	Password      string
+	IdentityToken string
+}
+
+// DockerConfigFile is the config.json shared with the docker CLI,
+// the fields docker-tar doesn't know are kept as they are on Save.
+type DockerConfigFile struct {
+	Auths       map[string]DockerAuthConfig
+	CredsStore  string
+	CredHelpers map[string]string
+
+	filename string
+	raw      map[string]json.RawMessage
+}
+
+// DockerConfigPath is config.json in $DOCKER_CONFIG or ~/.docker
+func DockerConfigPath() string {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if len(configDir) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configDir = filepath.Join(home, ".docker")
+	}
+	return filepath.Join(configDir, "config.json")
+}
+
+// LoadDockerConfig reads config.json, a missing file is an empty config.
+func LoadDockerConfig() (*DockerConfigFile, error) {
+	config := &DockerConfigFile{
+		Auths:       map[string]DockerAuthConfig{},
+		CredHelpers: map[string]string{},
+		filename:    DockerConfigPath(),
+		raw:         map[string]json.RawMessage{},
+	}
+	if len(config.filename) == 0 {
+		return config, nil
+	}
+	data, err := os.ReadFile(config.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return config, nil
+	}
+	if err := json.Unmarshal(data, &config.raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", config.filename, err)
+	}
+	fields := map[string]any{
+		"auths":       &config.Auths,
+		"credsStore":  &config.CredsStore,
+		"credHelpers": &config.CredHelpers,
+	}
+	for key, value := range fields {
+		if raw, ok := config.raw[key]; ok {
+			if err := json.Unmarshal(raw, value); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", config.filename, key, err)
+			}
+		}
+	}
+	if config.Auths == nil {
+		config.Auths = map[string]DockerAuthConfig{}
+	}
+	if config.CredHelpers == nil {
+		config.CredHelpers = map[string]string{}
+	}
+	return config, nil
+}
+
+// Save writes config.json through a temporary file, it holds secrets
+// so it is only readable by the user.
+func (config *DockerConfigFile) Save() error {
+	if len(config.filename) == 0 {
+		return fmt.Errorf("docker config path not found")
+	}
+	fields := map[string]any{
+		"auths":       config.Auths,
+		"credsStore":  config.CredsStore,
+		"credHelpers": config.CredHelpers,
+	}
+	for key, value := range fields {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		config.raw[key] = data
+	}
+	if len(config.CredsStore) == 0 {
+		delete(config.raw, "credsStore")
+	}
+	if len(config.CredHelpers) == 0 {
+		delete(config.raw, "credHelpers")
+	}
+	data, err := json.MarshalIndent(config.raw, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(config.filename), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(config.filename), filepath.Base(config.filename)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), config.filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// credentialHelper returns the helper storing the credentials of the registry,
+// credHelpers has the priority over credsStore.
+func (config *DockerConfigFile) credentialHelper(serverAddress string) string {
+	if helper, ok := config.CredHelpers[serverAddress]; ok {
+		return helper
+	}
+	if helper, ok := config.CredHelpers[registryHost(serverAddress)]; ok {
+		return helper
+	}
+	return config.CredsStore
+}
+
+// authKey returns the key of auths matching the registry, docker compares
+// the hosts so https://registry.example.com/v2/ matches registry.example.com.
+func (config *DockerConfigFile) authKey(serverAddress string) (string, bool) {
+	if _, ok := config.Auths[serverAddress]; ok {
+		return serverAddress, true
+	}
+	host := registryHost(serverAddress)
+	for key := range config.Auths {
+		if registryHost(key) == host {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Credentials returns the credentials of the registry, empty if not found.
+func (config *DockerConfigFile) Credentials(serverAddress string) (Credentials, error) {
+	if helper := config.credentialHelper(serverAddress); len(helper) > 0 {
+		return credentialHelperGet(helper, serverAddress)
+	}
+	key, ok := config.authKey(serverAddress)
+	if !ok {
+		return Credentials{}, nil
+	}
+	authConfig := config.Auths[key]
+	credentials := Credentials{
+		UserName:      authConfig.Username,
+		Password:      authConfig.Password,
+		IdentityToken: authConfig.IdentityToken,
+	}
+	if len(authConfig.Auth) > 0 {
+		decoded, err := base64.StdEncoding.DecodeString(authConfig.Auth)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("%s: invalid auth of %s: %v", config.filename, key, err)
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return Credentials{}, fmt.Errorf("%s: invalid auth of %s", config.filename, key)
+		}
+		credentials.UserName = username
+		credentials.Password = strings.Trim(password, "\x00")
+	}
+	return credentials, nil
+}
+
+// Store saves the credentials in the helper or in auths, like docker login
+func (config *DockerConfigFile) Store(serverAddress string, credentials Credentials) error {
+	if helper := config.credentialHelper(serverAddress); len(helper) > 0 {
+		if err := credentialHelperStore(helper, serverAddress, credentials); err != nil {
+			return err
+		}
+		// The helper keeps the secret, docker keeps an empty entry
+		config.Auths[serverAddress] = DockerAuthConfig{}
+		return config.Save()
+	}
+	authConfig := DockerAuthConfig{
+		IdentityToken: credentials.IdentityToken,
+	}
+	if len(credentials.IdentityToken) > 0 {
+		authConfig.Auth = base64.StdEncoding.EncodeToString([]byte(credentials.UserName + ":"))
+	} else {
+		authConfig.Auth = base64.StdEncoding.EncodeToString([]byte(credentials.UserName + ":" + credentials.Password))
+	}
+	if key, ok := config.authKey(serverAddress); ok {
+		delete(config.Auths, key)
+	}
+	config.Auths[serverAddress] = authConfig
+	return config.Save()
+}
+
+// Erase removes the credentials of the registry, like docker logout
+func (config *DockerConfigFile) Erase(serverAddress string) error {
+	if helper := config.credentialHelper(serverAddress); len(helper) > 0 {
+		if err := credentialHelperErase(helper, serverAddress); err != nil {
+			return err
+		}
+	}
+	key, ok := config.authKey(serverAddress)
+	if !ok {
+		return nil
+	}
+	delete(config.Auths, key)
+	return config.Save()
+}
+
+// registryHost strips the scheme and the path of a server address
+func registryHost(serverAddress string) string {
+	host := serverAddress
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+len("://"):]
+	}
+	host, _, _ = strings.Cut(host, "/")
+	return strings.ToLower(host)
+}
+
+// CredentialsServerAddress returns the key of the registry in config.json
+func CredentialsServerAddress(registry string) string {
+	switch registryHost(registry) {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return DockerHubServerAddress
+	}
+	return registryHost(registry)
+}
+
+var credentialsCache = struct {
+	sync.Mutex
+	values map[string]Credentials
+}{values: map[string]Credentials{}}
+
+// LookupCredentials returns the credentials of the registry from config.json,
+// a helper is run once for every registry.
+func LookupCredentials(registry string) (Credentials, error) {
+	serverAddress := CredentialsServerAddress(registry)
+	credentialsCache.Lock()
+	defer credentialsCache.Unlock()
+	if credentials, ok := credentialsCache.values[serverAddress]; ok {
+		return credentials, nil
+	}
+	config, err := LoadDockerConfig()
+	if err != nil {
+		return Credentials{}, err
+	}
+	credentials, err := config.Credentials(serverAddress)
+	if err != nil {
+		return Credentials{}, err
+	}
+	credentialsCache.values[serverAddress] = credentials
+	return credentials, nil
+}
+
+// LookupHelperCredentials returns the credentials of the registry from
+// docker-credential-<helper>, the helper is run once for every registry.
+func LookupHelperCredentials(helper string, registry string) (Credentials, error) {
+	serverAddress := CredentialsServerAddress(registry)
+	key := helper + " " + serverAddress
+	credentialsCache.Lock()
+	defer credentialsCache.Unlock()
+	if credentials, ok := credentialsCache.values[key]; ok {
+		return credentials, nil
+	}
+	credentials, err := credentialHelperGet(helper, serverAddress)
+	if err != nil {
+		return Credentials{}, err
+	}
+	credentialsCache.values[key] = credentials
+	return credentials, nil
+}
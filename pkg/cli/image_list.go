@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// ReadImageList reads one image per line, empty lines and
+// lines starting with # are skipped.
+func ReadImageList(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var images []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
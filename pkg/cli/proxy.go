@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ParseProxyURL reads the URL of a proxy, http://, https://, socks5:// or
+// socks5h://, with the credentials in it. A proxy without scheme is http.
+func ParseProxyURL(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy %s: unsupported scheme %s, http, https, socks5 or socks5h expected", u.Redacted(), u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("proxy %s: host expected", u.Redacted())
+	}
+	return u, nil
+}
@@ -0,0 +1,721 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Capabilities of an endpoint, as in containerd hosts.toml
+const (
+	// Pull blobs and manifests by digest
+	CapabilityPull = "pull"
+	// Resolve a tag to a manifest
+	CapabilityResolve = "resolve"
+)
+
+// The hosts.toml directory of containerd applied to every registry
+const hostsDefaultDirectory = "_default"
+
+// RegistryTLS are the TLS settings of a registry host
+type RegistryTLS struct {
+	SkipVerify bool
+	// PEM files trusted on top of the system roots
+	CAFiles            []string
+	ClientCertificates []ClientCertificate
+}
+
+// ClientCertificate is a PEM certificate and its key,
+// the key is read from the certificate file when KeyFile is empty.
+type ClientCertificate struct {
+	CertFile string
+	KeyFile  string
+}
+
+// RegistryEndpointConfig is the upstream registry or a mirror of a registry
+type RegistryEndpointConfig struct {
+	// scheme://host[:port][/path], the path is put before /v2
+	URL string
+	// The path of URL is the root of the API, /v2 is not added
+	OverridePath bool
+	// The prefix of the registry config is replaced by the host and the
+	// namespace, like a location of registries.conf. Otherwise the
+	// repository keeps its path.
+	Rewrite   bool
+	Namespace string
+	// HTTPS is not verified and plain HTTP is tried when it fails
+	Insecure bool
+	TLS      RegistryTLS
+	// Pull and resolve when empty
+	Capabilities []string
+	// Only used for the images pulled by tag
+	TagOnly bool
+	// The docker-credential-<helper> holding the credentials of the endpoint
+	CredentialHelper string
+	// Sent with every request to the endpoint
+	Header map[string][]string
+}
+
+func (endpoint *RegistryEndpointConfig) CanPull() bool {
+	return len(endpoint.Capabilities) == 0 || slices.Contains(endpoint.Capabilities, CapabilityPull)
+}
+
+func (endpoint *RegistryEndpointConfig) CanResolve() bool {
+	return len(endpoint.Capabilities) == 0 || slices.Contains(endpoint.Capabilities, CapabilityResolve)
+}
+
+// Host is the host[:port] of the endpoint
+func (endpoint *RegistryEndpointConfig) Host() string {
+	u, err := url.Parse(endpoint.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// RegistryConfig is the config of the images under a prefix
+type RegistryConfig struct {
+	// registry[/namespace] the config applies to, empty for every registry
+	Prefix string
+	// The registry of the image is used when nil
+	Upstream *RegistryEndpointConfig
+	// Tried in order before the upstream registry
+	Mirrors []RegistryEndpointConfig
+	// The images of the prefix can't be pulled
+	Blocked bool
+}
+
+// RegistriesConfig is a containers-registries.conf file,
+// or the hosts.toml files of a containerd certs.d directory.
+type RegistriesConfig struct {
+	Registries []RegistryConfig
+	// The keys of the files which are not read
+	Warnings []string
+}
+
+// LoadRegistriesConfig reads a registries.conf file, a hosts.toml file in
+// a directory named after its registry, or a certs.d directory of hosts.toml.
+func LoadRegistriesConfig(path string) (*RegistriesConfig, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &RegistriesConfig{}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			hostsFile := filepath.Join(path, entry.Name(), "hosts.toml")
+			if _, err := os.Stat(hostsFile); !entry.IsDir() || errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err := config.loadFile(hostsFile); err != nil {
+				return nil, err
+			}
+		}
+		return config, nil
+	}
+	if err := config.loadFile(path); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (config *RegistriesConfig) loadFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	table, err := parseTOML(name, data)
+	if err != nil {
+		return err
+	}
+	_, hasServer := table.get("server")
+	_, hasHost := table.get("host")
+	isHosts := hasServer || hasHost
+	config.warnUnknownKeys(name, table, isHosts)
+	table = normalizeTOMLKeys(table)
+	var registries []RegistryConfig
+	if isHosts {
+		var registry RegistryConfig
+		registry, err = parseHostsTOML(filepath.Base(filepath.Dir(name)), table)
+		registries = []RegistryConfig{registry}
+	} else {
+		registries, err = parseRegistriesConf(table)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for _, registry := range registries {
+		for _, endpoint := range registry.endpoints() {
+			if err := endpoint.TLS.check(); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	config.Registries = append(config.Registries, registries...)
+	return nil
+}
+
+// normalizeTOMLKeys spells the keys of hosts.toml like the ones of
+// registries.conf, skip_verify is read as skip-verify.
+func normalizeTOMLKeys(table *tomlTable) *tomlTable {
+	result := newTOMLTable()
+	for _, key := range table.keys {
+		value := table.values[key]
+		switch typed := value.(type) {
+		case *tomlTable:
+			value = normalizeTOMLKeys(typed)
+		case []*tomlTable:
+			tables := make([]*tomlTable, len(typed))
+			for i, child := range typed {
+				tables[i] = normalizeTOMLKeys(child)
+			}
+			value = tables
+		}
+		// The hosts are URLs and the headers are sent as they are
+		if key == "header" {
+			result.set(key, table.values[key])
+			continue
+		}
+		if _, isTable := value.(*tomlTable); !isTable || !strings.Contains(key, "/") {
+			key = strings.ReplaceAll(key, "_", "-")
+		}
+		result.set(key, value)
+	}
+	return result
+}
+
+// parseHostsTOML reads the hosts.toml of containerd for the registry
+// of its directory:
+//
+//	server = "https://registry-1.docker.io"
+//
+//	[host."https://mirror.example.com"]
+//	  capabilities = ["pull", "resolve"]
+//	  ca = "/etc/certs/mirror.pem"
+//	  client = [["/etc/certs/client.cert", "/etc/certs/client.key"]]
+//	  skip_verify = false
+//	  credential_helper = "mirror-login"
+//
+//	  [host."https://mirror.example.com".header]
+//	    x-custom = "value"
+func parseHostsTOML(namespace string, table *tomlTable) (RegistryConfig, error) {
+	registry := RegistryConfig{}
+	if namespace != hostsDefaultDirectory {
+		registry.Prefix = CanonicalRegistry(namespace)
+	}
+	server, err := tomlString(table, "server")
+	if err != nil {
+		return registry, err
+	}
+	if len(server) == 0 && len(registry.Prefix) > 0 {
+		server = "https://" + namespace
+		if registry.Prefix == dockerHubRegistry {
+			server = "https://" + dockerHubEndpoint
+		}
+	}
+	if len(server) > 0 {
+		upstream, err := parseHostsEndpoint(server, table)
+		if err != nil {
+			return registry, err
+		}
+		// The upstream registry can always be pulled from
+		upstream.Capabilities = nil
+		registry.Upstream = &upstream
+	}
+	hosts, err := tomlTableValue(table, "host")
+	if err != nil || hosts == nil {
+		return registry, err
+	}
+	for _, host := range hosts.keys {
+		hostTable, ok := hosts.values[host].(*tomlTable)
+		if !ok {
+			return registry, fmt.Errorf("host %s: table expected", host)
+		}
+		mirror, err := parseHostsEndpoint(host, hostTable)
+		if err != nil {
+			return registry, fmt.Errorf("host %s: %v", host, err)
+		}
+		registry.Mirrors = append(registry.Mirrors, mirror)
+	}
+	return registry, nil
+}
+
+func parseHostsEndpoint(host string, table *tomlTable) (RegistryEndpointConfig, error) {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return RegistryEndpointConfig{}, err
+	}
+	if len(u.Host) == 0 {
+		return RegistryEndpointConfig{}, fmt.Errorf("invalid host %s", host)
+	}
+	endpoint := RegistryEndpointConfig{
+		URL: strings.TrimSuffix(u.String(), "/"),
+	}
+	if endpoint.OverridePath, err = tomlBool(table, "override-path"); err != nil {
+		return endpoint, err
+	}
+	if endpoint.Capabilities, err = tomlStrings(table, "capabilities"); err != nil {
+		return endpoint, err
+	}
+	if endpoint.CredentialHelper, err = tomlString(table, "credential-helper"); err != nil {
+		return endpoint, err
+	}
+	if endpoint.Header, err = parseHeader(table); err != nil {
+		return endpoint, err
+	}
+	endpoint.TLS, err = parseRegistryTLS(table)
+	return endpoint, err
+}
+
+// parseHeader reads the header table, a value is a string or an array of strings
+func parseHeader(table *tomlTable) (map[string][]string, error) {
+	headerTable, err := tomlTableValue(table, "header")
+	if err != nil || headerTable == nil {
+		return nil, err
+	}
+	header := map[string][]string{}
+	for _, key := range headerTable.keys {
+		values, err := tomlStrings(headerTable, key)
+		if err != nil {
+			return nil, fmt.Errorf("header %v", err)
+		}
+		header[key] = values
+	}
+	return header, nil
+}
+
+// The keys read from the tables of the files
+var (
+	hostsEndpointKeys = []string{"capabilities", "ca", "client", "skip-verify", "override-path", "credential-helper", "header"}
+	hostsKeys         = append([]string{"server", "host"}, hostsEndpointKeys...)
+	registryKeys      = []string{"prefix", "location", "insecure", "blocked", "mirror-by-digest-only", "mirror", "ca", "client", "skip-verify", "credential-helper"}
+	mirrorKeys        = []string{"location", "insecure", "pull-from-mirror", "ca", "client", "skip-verify", "credential-helper"}
+)
+
+// warnUnknownKeys reports the keys which are not read, like the dial_timeout
+// of hosts.toml. The global settings of registries.conf are not checked,
+// like unqualified-search-registries, they don't apply to a pull by name.
+func (config *RegistriesConfig) warnUnknownKeys(name string, table *tomlTable, isHosts bool) {
+	warn := func(table *tomlTable, known []string, context string) {
+		for _, key := range table.keys {
+			if !slices.Contains(known, strings.ReplaceAll(key, "_", "-")) {
+				config.Warnings = append(config.Warnings, fmt.Sprintf("%s: %s%s is not supported, it is ignored", name, context, key))
+			}
+		}
+	}
+	if isHosts {
+		warn(table, hostsKeys, "")
+		if hosts, ok := table.values["host"].(*tomlTable); ok {
+			for _, host := range hosts.keys {
+				if hostTable, ok := hosts.values[host].(*tomlTable); ok {
+					warn(hostTable, hostsEndpointKeys, fmt.Sprintf("host %s: ", host))
+				}
+			}
+		}
+		return
+	}
+	registries, _ := table.values["registry"].([]*tomlTable)
+	for _, registry := range registries {
+		warn(registry, registryKeys, "registry: ")
+		mirrors, _ := registry.values["mirror"].([]*tomlTable)
+		for _, mirror := range mirrors {
+			warn(mirror, mirrorKeys, "registry.mirror: ")
+		}
+	}
+}
+
+// parseRegistriesConf reads the registries of containers-registries.conf,
+// the version 2 format:
+//
+//	[[registry]]
+//	prefix = "docker.io/library"
+//	location = "registry.example.com/hub"
+//	insecure = false
+//	credential-helper = "example-login"
+//
+//	[[registry.mirror]]
+//	location = "mirror.example.com"
+//	pull-from-mirror = "digest-only"
+//
+// and the insecure and blocked lists of the version 1 format.
+// ca, client and skip-verify are read like in hosts.toml.
+func parseRegistriesConf(table *tomlTable) ([]RegistryConfig, error) {
+	var registries []RegistryConfig
+	value, ok := table.get("registry")
+	if ok {
+		tables, ok := value.([]*tomlTable)
+		if !ok {
+			return nil, fmt.Errorf("registry: array of tables expected")
+		}
+		for _, registryTable := range tables {
+			registry, err := parseRegistriesConfRegistry(registryTable)
+			if err != nil {
+				return nil, err
+			}
+			registries = append(registries, registry)
+		}
+	}
+	v1, err := tomlTableValue(table, "registries")
+	if err != nil || v1 == nil {
+		return registries, err
+	}
+	for _, list := range []string{"insecure", "block"} {
+		listTable, err := tomlTableValue(v1, list)
+		if err != nil {
+			return nil, err
+		}
+		if listTable == nil {
+			continue
+		}
+		hosts, err := tomlStrings(listTable, "registries")
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			registry := RegistryConfig{
+				Prefix:  CanonicalRegistry(host),
+				Blocked: list == "block",
+			}
+			if list == "insecure" {
+				registry.Upstream = &RegistryEndpointConfig{
+					URL:      "https://" + registryLocationHost(host),
+					Insecure: true,
+					TLS:      RegistryTLS{SkipVerify: true},
+				}
+			}
+			registries = append(registries, registry)
+		}
+	}
+	return registries, nil
+}
+
+func parseRegistriesConfRegistry(table *tomlTable) (RegistryConfig, error) {
+	registry := RegistryConfig{}
+	prefix, err := tomlString(table, "prefix")
+	if err != nil {
+		return registry, err
+	}
+	location, err := tomlString(table, "location")
+	if err != nil {
+		return registry, err
+	}
+	if len(prefix) == 0 {
+		prefix = location
+	}
+	if len(prefix) == 0 {
+		return registry, fmt.Errorf("registry: prefix or location required")
+	}
+	registry.Prefix = CanonicalRegistry(prefix)
+	if registry.Blocked, err = tomlBool(table, "blocked"); err != nil {
+		return registry, err
+	}
+	digestOnly, err := tomlBool(table, "mirror-by-digest-only")
+	if err != nil {
+		return registry, err
+	}
+	insecure, err := tomlBool(table, "insecure")
+	if err != nil {
+		return registry, err
+	}
+	tlsConfig, err := parseRegistryTLS(table)
+	if err != nil {
+		return registry, err
+	}
+	credentialHelper, err := tomlString(table, "credential-helper")
+	if err != nil {
+		return registry, err
+	}
+	if strings.HasPrefix(registry.Prefix, "*.") {
+		if len(location) > 0 && location != prefix {
+			return registry, fmt.Errorf("registry %s: a wildcard prefix has no location", prefix)
+		}
+	} else {
+		if len(location) == 0 {
+			location = prefix
+		}
+		upstream := registriesConfEndpoint(location, insecure, tlsConfig)
+		upstream.CredentialHelper = credentialHelper
+		registry.Upstream = &upstream
+	}
+	value, ok := table.get("mirror")
+	if !ok {
+		return registry, nil
+	}
+	mirrors, ok := value.([]*tomlTable)
+	if !ok {
+		return registry, fmt.Errorf("registry %s: mirror: array of tables expected", prefix)
+	}
+	for _, mirrorTable := range mirrors {
+		location, err := tomlString(mirrorTable, "location")
+		if err != nil {
+			return registry, err
+		}
+		if len(location) == 0 {
+			return registry, fmt.Errorf("registry %s: mirror location required", prefix)
+		}
+		insecure, err := tomlBool(mirrorTable, "insecure")
+		if err != nil {
+			return registry, err
+		}
+		tlsConfig, err := parseRegistryTLS(mirrorTable)
+		if err != nil {
+			return registry, err
+		}
+		mirror := registriesConfEndpoint(location, insecure, tlsConfig)
+		if mirror.CredentialHelper, err = tomlString(mirrorTable, "credential-helper"); err != nil {
+			return registry, err
+		}
+		pullFromMirror, err := tomlString(mirrorTable, "pull-from-mirror")
+		if err != nil {
+			return registry, err
+		}
+		switch pullFromMirror {
+		case "", "all":
+			if digestOnly {
+				mirror.Capabilities = []string{CapabilityPull}
+			}
+		case "digest-only":
+			mirror.Capabilities = []string{CapabilityPull}
+		case "tag-only":
+			mirror.TagOnly = true
+		default:
+			return registry, fmt.Errorf("registry %s: unknown pull-from-mirror %s", prefix, pullFromMirror)
+		}
+		registry.Mirrors = append(registry.Mirrors, mirror)
+	}
+	return registry, nil
+}
+
+// registriesConfEndpoint reads a location, host[:port][/namespace]
+func registriesConfEndpoint(location string, insecure bool, tlsConfig RegistryTLS) RegistryEndpointConfig {
+	host, namespace, _ := strings.Cut(location, "/")
+	if insecure {
+		tlsConfig.SkipVerify = true
+	}
+	return RegistryEndpointConfig{
+		URL:       "https://" + registryLocationHost(host),
+		Rewrite:   true,
+		Namespace: namespace,
+		Insecure:  insecure,
+		TLS:       tlsConfig,
+	}
+}
+
+// registryLocationHost is the host serving the API of a registry
+func registryLocationHost(host string) string {
+	if CanonicalRegistry(host) == dockerHubRegistry {
+		return dockerHubEndpoint
+	}
+	return host
+}
+
+// parseRegistryTLS reads ca, client and skip-verify, a client is a PEM file
+// holding the certificate and the key, a [cert, key] pair, or a list of them.
+func parseRegistryTLS(table *tomlTable) (RegistryTLS, error) {
+	var tlsConfig RegistryTLS
+	var err error
+	if tlsConfig.SkipVerify, err = tomlBool(table, "skip-verify"); err != nil {
+		return tlsConfig, err
+	}
+	if tlsConfig.CAFiles, err = tomlStrings(table, "ca"); err != nil {
+		return tlsConfig, err
+	}
+	value, ok := table.get("client")
+	if !ok {
+		return tlsConfig, nil
+	}
+	var pairs []any
+	switch value := value.(type) {
+	case string:
+		pairs = []any{value}
+	case []any:
+		pairs = value
+	default:
+		return tlsConfig, fmt.Errorf("client: string or array expected")
+	}
+	for _, pair := range pairs {
+		switch pair := pair.(type) {
+		case string:
+			tlsConfig.ClientCertificates = append(tlsConfig.ClientCertificates, ClientCertificate{CertFile: pair})
+		case []any:
+			if len(pair) != 2 {
+				return tlsConfig, fmt.Errorf("client: [cert, key] expected")
+			}
+			certFile, ok1 := pair[0].(string)
+			keyFile, ok2 := pair[1].(string)
+			if !ok1 || !ok2 {
+				return tlsConfig, fmt.Errorf("client: [cert, key] expected")
+			}
+			tlsConfig.ClientCertificates = append(tlsConfig.ClientCertificates, ClientCertificate{certFile, keyFile})
+		default:
+			return tlsConfig, fmt.Errorf("client: [cert, key] expected")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// check reports the missing files early, with the name of the config file
+func (tlsConfig *RegistryTLS) check() error {
+	files := append([]string{}, tlsConfig.CAFiles...)
+	for _, certificate := range tlsConfig.ClientCertificates {
+		files = append(files, certificate.CertFile, certificate.KeyFile)
+	}
+	for _, file := range files {
+		if len(file) == 0 {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tomlString(table *tomlTable, key string) (string, error) {
+	value, ok := table.get(key)
+	if !ok {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: string expected", key)
+	}
+	return s, nil
+}
+
+func tomlBool(table *tomlTable, key string) (bool, error) {
+	value, ok := table.get(key)
+	if !ok {
+		return false, nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s: boolean expected", key)
+	}
+	return b, nil
+}
+
+// tomlStrings reads a string or an array of strings
+func tomlStrings(table *tomlTable, key string) ([]string, error) {
+	value, ok := table.get(key)
+	if !ok {
+		return nil, nil
+	}
+	if s, ok := value.(string); ok {
+		return []string{s}, nil
+	}
+	values, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: array of strings expected", key)
+	}
+	result := make([]string, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: array of strings expected", key)
+		}
+		result[i] = s
+	}
+	return result, nil
+}
+
+func tomlTableValue(table *tomlTable, key string) (*tomlTable, error) {
+	value, ok := table.get(key)
+	if !ok {
+		return nil, nil
+	}
+	child, ok := value.(*tomlTable)
+	if !ok {
+		return nil, fmt.Errorf("%s: table expected", key)
+	}
+	return child, nil
+}
+
+// endpoints are the mirrors and the upstream registry
+func (registry *RegistryConfig) endpoints() []RegistryEndpointConfig {
+	endpoints := append([]RegistryEndpointConfig{}, registry.Mirrors...)
+	if registry.Upstream != nil {
+		endpoints = append(endpoints, *registry.Upstream)
+	}
+	return endpoints
+}
+
+// matches tells if the config applies to the registry[/path] reference
+func (registry *RegistryConfig) matches(reference string) bool {
+	prefix := registry.Prefix
+	if len(prefix) == 0 {
+		return true
+	}
+	if wildcard, ok := strings.CutPrefix(prefix, "*"); ok {
+		host, _, _ := strings.Cut(reference, "/")
+		return strings.HasSuffix(host, wildcard)
+	}
+	return reference == prefix || strings.HasPrefix(reference, prefix+"/")
+}
+
+// Lookup returns the config of the registry[/path] reference, the longest
+// prefix wins and a wildcard prefix only matches when no other does.
+func (config *RegistriesConfig) Lookup(reference string) (*RegistryConfig, bool) {
+	reference = CanonicalRegistry(reference)
+	var result *RegistryConfig
+	score := -1
+	for i := range config.Registries {
+		registry := &config.Registries[i]
+		if !registry.matches(reference) {
+			continue
+		}
+		registryScore := len(registry.Prefix)
+		if strings.HasPrefix(registry.Prefix, "*") || len(registry.Prefix) == 0 {
+			registryScore = 0
+		}
+		if registryScore > score {
+			result, score = registry, registryScore
+		}
+	}
+	return result, result != nil
+}
+
+// TLS returns the TLS settings of a host[:port], the first endpoint of the
+// host in the config has them.
+func (config *RegistriesConfig) TLS(host string) (RegistryTLS, bool) {
+	for i := range config.Registries {
+		for _, endpoint := range config.Registries[i].endpoints() {
+			if strings.EqualFold(endpoint.Host(), host) {
+				return endpoint.TLS, true
+			}
+		}
+	}
+	return RegistryTLS{}, false
+}
+
+// The name of Docker Hub in the references and the host of its API
+const (
+	dockerHubRegistry = "docker.io"
+	dockerHubEndpoint = "registry-1.docker.io"
+)
+
+// CanonicalRegistry lower cases the registry of a registry[/path] reference,
+// the hosts of Docker Hub are named docker.io.
+func CanonicalRegistry(reference string) string {
+	host, path, hasPath := strings.Cut(reference, "/")
+	host = strings.ToLower(host)
+	switch host {
+	case "index.docker.io", dockerHubEndpoint:
+		host = dockerHubRegistry
+	}
+	if hasPath {
+		return host + "/" + path
+	}
+	return host
+}
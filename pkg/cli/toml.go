@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tomlTable keeps the keys in the order of the file,
+// the hosts of hosts.toml are tried in that order.
+type tomlTable struct {
+	keys   []string
+	values map[string]any
+}
+
+func newTOMLTable() *tomlTable {
+	return &tomlTable{values: map[string]any{}}
+}
+
+func (table *tomlTable) get(key string) (any, bool) {
+	value, ok := table.values[key]
+	return value, ok
+}
+
+func (table *tomlTable) set(key string, value any) {
+	if _, ok := table.values[key]; !ok {
+		table.keys = append(table.keys, key)
+	}
+	table.values[key] = value
+}
+
+// parseTOML decodes the file into tables keeping the order of the keys,
+// the tables are *tomlTable and the arrays of tables []*tomlTable.
+func parseTOML(name string, data []byte) (*tomlTable, error) {
+	var values map[string]any
+	metadata, err := toml.Decode(string(data), &values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	// The position of a key in the file, by its path
+	order := map[string]int{}
+	for index, key := range metadata.Keys() {
+		path := strings.Join(key, "\x00")
+		if _, ok := order[path]; !ok {
+			order[path] = index
+		}
+	}
+	return orderedTOMLTable(values, nil, order), nil
+}
+
+func orderedTOMLTable(values map[string]any, path []string, order map[string]int) *tomlTable {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	position := func(key string) int {
+		if index, ok := order[strings.Join(append(path[:len(path):len(path)], key), "\x00")]; ok {
+			return index
+		}
+		return len(order)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if position(keys[i]) != position(keys[j]) {
+			return position(keys[i]) < position(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	table := newTOMLTable()
+	for _, key := range keys {
+		childPath := append(path[:len(path):len(path)], key)
+		switch value := values[key].(type) {
+		case map[string]any:
+			table.set(key, orderedTOMLTable(value, childPath, order))
+		case []map[string]any:
+			tables := make([]*tomlTable, len(value))
+			for i, child := range value {
+				tables[i] = orderedTOMLTable(child, childPath, order)
+			}
+			table.set(key, tables)
+		case []any:
+			// An array of inline tables
+			tables := make([]*tomlTable, 0, len(value))
+			for _, element := range value {
+				if child, ok := element.(map[string]any); ok {
+					tables = append(tables, orderedTOMLTable(child, childPath, order))
+				}
+			}
+			if len(value) > 0 && len(tables) == len(value) {
+				table.set(key, tables)
+			} else {
+				table.set(key, value)
+			}
+		default:
+			table.set(key, value)
+		}
+	}
+	return table
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AttestationFetcher pulls the provenance and SBOM attestations buildx
+// pushes next to the image, they are small enough to be kept in memory.
+type AttestationFetcher struct {
+	enabled    bool
+	descriptor v1.Descriptor
+	blobs      map[digest.Digest][]byte
+
+	authenticator    *Authenticator
+	requestInfo      *RequestInfoManager
+	imageIndex       *ImageIndexFetcher
+	imageConfig      *ImageConfigFetcher
+	blobCache        *BlobCache
+	httpClientCreate HttpClientFn
+	initialized      bool
+}
+
+func (attestation *AttestationFetcher) Initialize(entry *EntryPoint) {
+	if entry == nil {
+		panic("AttestationFetcher init failed, EntryPoint is nil")
+	}
+	if entry.RequestInfoManager == nil {
+		panic("AttestationFetcher init failed, EntryPoint's RequestInfoManager is nil")
+	}
+	if entry.Authenticator == nil {
+		panic("AttestationFetcher init failed, EntryPoint's Authenticator is nil")
+	}
+	if entry.ImageIndexFetcher == nil {
+		panic("AttestationFetcher init failed, EntryPoint's ImageIndexFetcher is nil")
+	}
+	if entry.ImageConfigFetcher == nil {
+		panic("AttestationFetcher init failed, EntryPoint's ImageConfigFetcher is nil")
+	}
+	if entry.BlobCache == nil {
+		panic("AttestationFetcher init failed, EntryPoint's BlobCache is nil")
+	}
+	if entry.HttpClientFnPtr == nil {
+		panic("AttestationFetcher init failed, EntryPoint's httpClientFnPtr is nil")
+	}
+	attestation.authenticator = entry.Authenticator
+	attestation.requestInfo = entry.RequestInfoManager
+	attestation.imageIndex = entry.ImageIndexFetcher
+	attestation.imageConfig = entry.ImageConfigFetcher
+	attestation.blobCache = entry.BlobCache
+	attestation.httpClientCreate = *entry.HttpClientFnPtr
+	attestation.initialized = true
+}
+
+func (attestation *AttestationFetcher) InitializeCheck() {
+	if attestation.initialized {
+		return
+	}
+	panic("AttestationFetcher not init")
+}
+
+func (attestation *AttestationFetcher) ApplyConfig(config *cli.Config) error {
+	if config == nil {
+		return fmt.Errorf("attestationFetcher: ApplyConfig Failed, Config object is nil")
+	}
+	attestation.enabled = config.Attestations()
+	return nil
+}
+
+func (attestation *AttestationFetcher) Run() error {
+	if !attestation.enabled {
+		return nil
+	}
+	manifestDigest := attestation.imageConfig.ManifestDescriptor().Digest
+	descriptor, ok := attestation.imageIndex.Attestation(manifestDigest)
+	if !ok {
+		fmt.Println("No attestation found for", attestation.requestInfo.Platform())
+		return nil
+	}
+	content, err := attestation.fetchManifest(descriptor)
+	if err != nil {
+		return err
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return err
+	}
+	blobs := map[digest.Digest][]byte{descriptor.Digest: content}
+	for _, blob := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+		content, err := attestation.fetchBlob(blob)
+		if err != nil {
+			return err
+		}
+		blobs[blob.Digest] = content
+		if predicateType, ok := blob.Annotations[AnnotationPredicateType]; ok {
+			fmt.Println("Attestation:", predicateType)
+		}
+	}
+	attestation.descriptor = descriptor
+	attestation.blobs = blobs
+	return nil
+}
+
+func (attestation *AttestationFetcher) fetchManifest(descriptor v1.Descriptor) ([]byte, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	requestInfo := attestation.requestInfo
+	manifestURL := fmt.Sprintf("%s/manifests/%s",
+		requestInfo.RepositoryURL(),
+		descriptor.Digest)
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HeaderAccept, descriptor.MediaType)
+	resp, err := attestation.authenticator.Do(attestation.httpClientCreate(), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get attestation manifest failed, %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyManifest(descriptor.Digest, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (attestation *AttestationFetcher) fetchBlob(descriptor v1.Descriptor) ([]byte, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	body, ok := attestation.blobCache.ReadAll(descriptor.Digest)
+	if ok {
+		return body, nil
+	}
+	body, err := fetchBlob(attestation.httpClientCreate(), attestation.requestInfo,
+		attestation.authenticator, descriptor.Digest, descriptor.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	if attestation.blobCache.Enabled() {
+		attestation.blobCache.Store(descriptor.Digest, body)
+	}
+	return body, nil
+}
+
+// Descriptor returns the attestation manifest as listed in the image index,
+// false if no attestation was pulled.
+func (attestation *AttestationFetcher) Descriptor() (v1.Descriptor, bool) {
+	return attestation.descriptor, attestation.blobs != nil
+}
+
+// Blobs returns the attestation manifest, config and layers by digest
+func (attestation *AttestationFetcher) Blobs() map[digest.Digest][]byte {
+	return attestation.blobs
+}
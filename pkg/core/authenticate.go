@@ -7,15 +7,71 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	authSchemeBearer = "bearer"
+	authSchemeBasic  = "basic"
 )
 
+// The client_id sent to the OAuth2 token endpoints
+const oauth2ClientID = "docker-tar"
+
+// The token is refreshed this long before it expires
+const tokenExpiryMargin = 10 * time.Second
+
+// A failed token refresh is not tried again before this delay
+const tokenRefreshBackoff = 5 * time.Second
+
+// The lifetime of a token without expires_in, as in the distribution spec
+const minimumTokenLifetime = 60 * time.Second
+
 type Authenticator struct {
-	token string
+	// The mirrors in order, then the upstream registry
+	endpoints     []*endpointAuth
+	endpointsOnce sync.Once
+	// The endpoint which served each blob
+	servedMutex sync.Mutex
+	servedBlobs map[digest.Digest]string
 
 	requestInfo      *RequestInfoManager
 	httpClientCreate HttpClientFn
-	initialized      bool
+	// Optional, shares the auth state of the endpoints with the other entries
+	pool        *HttpClientPool
+	initialized bool
+}
+
+// endpointAuth is the auth state of one endpoint of the registry
+type endpointAuth struct {
+	// Shared by the parallel downloads
+	sync.Mutex
+	endpoint    registryEndpoint
+	credentials cli.Credentials
+	// Another endpoint is tried when this one fails
+	fallback bool
+	// The endpoint is challenged on first use, a failed challenge is not sent again
+	challenged   bool
+	challengeErr error
+	// The scheme in use, empty when the registry needs no auth
+	scheme       string
+	token        string
+	refreshToken string
+	expiresAt    time.Time
+	// A single refresh runs at a time, a failed one waits for the backoff
+	refreshing     bool
+	refreshErr     error
+	refreshRetryAt time.Time
+	// The last Bearer challenge
+	realm   string
+	service string
+
+	httpClientCreate HttpClientFn
 }
 
 func (auth *Authenticator) Initialize(entry *EntryPoint) {
@@ -30,6 +86,7 @@ func (auth *Authenticator) Initialize(entry *EntryPoint) {
 	}
 	auth.requestInfo = entry.RequestInfoManager
 	auth.httpClientCreate = *entry.HttpClientFnPtr
+	auth.pool = entry.HttpClientPool
 	auth.initialized = true
 }
 
@@ -44,105 +101,622 @@ func (auth *Authenticator) Run() error {
 	return auth.Challenge()
 }
 
+// registryEndpoints creates the auth state of the endpoints once
+// RequestInfoManager has applied the config.
+func (auth *Authenticator) registryEndpoints() []*endpointAuth {
+	auth.endpointsOnce.Do(func() {
+		endpoints := auth.requestInfo.RegistryEndpoints()
+		for index, endpoint := range endpoints {
+			endpointAuth := &endpointAuth{
+				endpoint:         endpoint,
+				credentials:      auth.requestInfo.Credentials(endpoint.url),
+				fallback:         index < len(endpoints)-1,
+				httpClientCreate: auth.httpClientCreate,
+			}
+			if auth.pool != nil {
+				endpointAuth = auth.pool.endpointAuth(endpointAuth)
+			}
+			auth.endpoints = append(auth.endpoints, endpointAuth)
+		}
+	})
+	return auth.endpoints
+}
+
+// Challenge authenticates against the first endpoint which answers,
+// the next ones are only challenged when a request falls back to them.
 func (auth *Authenticator) Challenge() error {
 	client := auth.httpClientCreate()
-	challengeURL := fmt.Sprintf("%s/v2/", auth.requestInfo.RegistryEndpoint())
+	var err error
+	for _, endpoint := range auth.registryEndpoints() {
+		if err = endpoint.ensureChallenged(client); err == nil {
+			return nil
+		}
+	}
+	if err == nil {
+		return fmt.Errorf("no registry endpoint")
+	}
+	return err
+}
+
+// Do sends the request built against RepositoryURL to the endpoints serving
+// it in order, the next one is tried when an endpoint is down, times out,
+// misses the content or refuses it. A timeout is not retried on an endpoint
+// followed by another one. The answer of the last endpoint is returned as it is.
+func (auth *Authenticator) Do(client *http.Client, req *http.Request) (*http.Response, error) {
+	var endpoints []*endpointAuth
+	repositoryRequest, ok := strings.CutPrefix(req.URL.String(), auth.requestInfo.RepositoryURL())
+	for _, endpoint := range auth.registryEndpoints() {
+		if ok && endpoint.endpoint.serves(repositoryRequest) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	// Not a request of the repository, only the first endpoint is asked
+	if len(endpoints) == 0 {
+		endpoints = auth.registryEndpoints()[:1]
+	}
+	var lastErr error
+	for index, endpoint := range endpoints {
+		last := index == len(endpoints)-1
+		endpointReq, err := endpoint.request(req, repositoryRequest)
+		if err != nil {
+			return nil, err
+		}
+		// The failed challenge was reported already
+		if err := endpoint.ensureChallenged(client); err != nil {
+			if last {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if !last {
+			endpointReq = withEndpointFallback(endpointReq)
+		}
+		resp, err := endpoint.do(client, endpointReq)
+		if err != nil {
+			if last || req.Context().Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			printf("%v, trying %s\n", err, endpoints[index+1].endpoint.url)
+			continue
+		}
+		if last || !fallbackStatus(resp.StatusCode) {
+			auth.served(repositoryRequest, endpoint.endpoint.url, resp)
+			return resp, nil
+		}
+		resp.Body.Close()
+		printf("%s %s: %s, trying %s\n", req.Method, endpointReq.URL.Redacted(), resp.Status, endpoints[index+1].endpoint.url)
+	}
+	return nil, lastErr
+}
+
+// fallbackStatus tells if another endpoint may answer better,
+// a mirror may not have the content or not accept the credentials.
+func fallbackStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusNotFound,
+		http.StatusTooManyRequests:
+		return true
+	}
+	return statusCode >= http.StatusInternalServerError
+}
+
+// served remembers the endpoint of a blob for the report of the pull
+func (auth *Authenticator) served(repositoryRequest string, endpoint string, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return
+	}
+	reference, ok := strings.CutPrefix(repositoryRequest, "/blobs/")
+	if !ok {
+		return
+	}
+	blobDigest, err := digest.Parse(reference)
+	if err != nil {
+		return
+	}
+	auth.servedMutex.Lock()
+	defer auth.servedMutex.Unlock()
+	if auth.servedBlobs == nil {
+		auth.servedBlobs = map[digest.Digest]string{}
+	}
+	auth.servedBlobs[blobDigest] = endpoint
+}
+
+// ServedBy returns the endpoint which served the blob, false if the blob
+// was not fetched from the registry, like a cached one.
+func (auth *Authenticator) ServedBy(blobDigest digest.Digest) (string, bool) {
+	auth.servedMutex.Lock()
+	defer auth.servedMutex.Unlock()
+	endpoint, ok := auth.servedBlobs[blobDigest]
+	return endpoint, ok
+}
+
+// request moves the request of the repository to the endpoint
+func (auth *endpointAuth) request(req *http.Request, repositoryRequest string) (*http.Request, error) {
+	if len(repositoryRequest) == 0 {
+		return req, nil
+	}
+	u, err := url.Parse(auth.endpoint.repositoryURL() + repositoryRequest)
+	if err != nil {
+		return nil, err
+	}
+	if u.String() == req.URL.String() {
+		return req, nil
+	}
+	endpointReq := req.Clone(req.Context())
+	endpointReq.URL = u
+	endpointReq.Host = ""
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		endpointReq.Body = body
+	}
+	return endpointReq, nil
+}
+
+// ensureChallenged challenges the endpoint on first use
+func (auth *endpointAuth) ensureChallenged(client *http.Client) error {
+	auth.Lock()
+	defer auth.Unlock()
+	if !auth.challenged {
+		auth.challengeErr = auth.challenge(client)
+		auth.challenged = true
+		if auth.challengeErr != nil && auth.fallback {
+			printf("%s: %v, trying the next endpoint\n", auth.endpoint.url, auth.challengeErr)
+		}
+	}
+	return auth.challengeErr
+}
+
+func (auth *endpointAuth) challenge(client *http.Client) error {
+	challengeURL := auth.endpoint.apiURL() + "/"
 	req, err := http.NewRequest(http.MethodGet, challengeURL, nil)
 	if err != nil {
 		return err
 	}
-	requestInfo := auth.requestInfo
-	resp, err := client.Do(req)
+	if auth.fallback {
+		req = withEndpointFallback(req)
+	}
+	resp, err := client.Do(auth.endpointRequest(req))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	var realm string
-	var service string
-	if resp.StatusCode == http.StatusUnauthorized {
-		// Copy from azure
-		// matches challenges having quoted parameters, capturing scheme and parameters
-		challenge := regexp.MustCompile(`(?:(\w+) ((?:\w+="[^"]*",?\s*)+))`)
-		// captures parameter names and values in a match of the above expression
-		challengeParams := regexp.MustCompile(`(\w+)="([^"]*)"`)
-		// WWW-Authenticate can have multiple values, each containing multiple challenges
-		for _, h := range resp.Header.Values(HeaderWWWAuthenticate) {
-			for _, sm := range challenge.FindAllStringSubmatch(h, -1) {
-				// sm is [challenge, scheme, params] (see regexp documentation on submatches)
-				for _, sm := range challengeParams.FindAllStringSubmatch(sm[2], -1) {
-					// sm is [key="value", key, value] (see regexp documentation on submatches)
-					if sm[1] == "realm" {
-						realm = sm[2]
-					}
-					if sm[1] == "service" {
-						service = sm[2]
-					}
-				}
-			}
-		}
-	} else {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// A plain registry or an open mirror, no auth required
+		auth.scheme = ""
+		return nil
+	case http.StatusUnauthorized:
+	default:
 		return fmt.Errorf("challage failed, %s", resp.Status)
 	}
-	if len(service) == 0 || len(realm) == 0 {
-		return fmt.Errorf("auth endpoint not found")
+	challenges := parseChallenges(resp.Header.Values(HeaderWWWAuthenticate))
+	if bearer, ok := challenges[authSchemeBearer]; ok {
+		return auth.bearerToken(client, bearer["realm"], bearer["service"])
 	}
-	baseURL := realm
-	params := url.Values{}
-	params.Add("scope", fmt.Sprintf(
-		"repository:%s/%s:pull",
-		requestInfo.Repository(),
-		requestInfo.ImageName()))
-	params.Add("service", service)
-	u, err := url.Parse(baseURL)
+	if _, ok := challenges[authSchemeBasic]; ok {
+		return auth.basicAuth(client, challengeURL)
+	}
+	return fmt.Errorf("auth endpoint not found")
+}
+
+// basicAuth checks the credentials against a registry which only offers
+// Basic challenges, they are sent on every request then.
+func (auth *endpointAuth) basicAuth(client *http.Client, challengeURL string) error {
+	credentials := auth.credentials
+	if len(credentials.UserName) == 0 || len(credentials.Password) == 0 {
+		return fmt.Errorf("registry requires basic auth, username and password needed")
+	}
+	auth.scheme = authSchemeBasic
+	req, err := http.NewRequest(http.MethodGet, challengeURL, nil)
 	if err != nil {
 		return err
 	}
-	u.RawQuery = params.Encode()
-	req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+	req.SetBasicAuth(credentials.UserName, credentials.Password)
+	resp, err := client.Do(auth.endpointRequest(req))
 	if err != nil {
 		return err
 	}
-	username := requestInfo.UserName()
-	password := requestInfo.Password()
-	if len(username) > 0 && len(password) > 0 {
-		loginToken := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
-		req.Header.Set(HeaderAuthorization, BasicTokenPrefix+loginToken)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("basic auth failed, %s", resp.Status)
+	}
+	return nil
+}
+
+func (auth *endpointAuth) bearerToken(client *http.Client, realm string, service string) error {
+	if len(realm) == 0 {
+		return fmt.Errorf("auth endpoint not found")
+	}
+	auth.realm = realm
+	auth.service = service
+	return auth.fetchToken(client)
+}
+
+// tokenSource is what a token is asked with, copied under the lock
+type tokenSource struct {
+	realm        string
+	service      string
+	repository   string
+	refreshToken string
+	credentials  cli.Credentials
+}
+
+type tokenResponse struct {
+	Token        string    `json:"token"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int       `json:"expires_in"`
+	IssuedAt     time.Time `json:"issued_at"`
+}
+
+func (auth *endpointAuth) tokenSource() tokenSource {
+	return tokenSource{
+		realm:        auth.realm,
+		service:      auth.service,
+		repository:   auth.endpoint.repository,
+		refreshToken: auth.refreshToken,
+		credentials:  auth.credentials,
 	}
-	resp, err = client.Do(req)
+}
+
+// fetchToken asks a token to the realm of the last Bearer challenge,
+// the lock is held.
+func (auth *endpointAuth) fetchToken(client *http.Client) error {
+	token, err := auth.requestToken(client, auth.tokenSource())
 	if err != nil {
 		return err
 	}
+	auth.setToken(token)
+	return nil
+}
+
+// requestToken asks a token without holding the lock.
+// A refresh token is exchanged with the OAuth2 POST flow, the registries
+// which don't serve GET get the credentials by POST too.
+func (auth *endpointAuth) requestToken(client *http.Client, source tokenSource) (*tokenResponse, error) {
+	credentials := source.credentials
+	params := url.Values{}
+	// A login has no repository
+	if repositoryPath := source.repository; len(repositoryPath) > 0 {
+		params.Add("scope", fmt.Sprintf(
+			"repository:%s:pull",
+			repositoryPath))
+	}
+	if len(source.service) > 0 {
+		params.Add("service", source.service)
+	}
+	refreshToken := source.refreshToken
+	if len(refreshToken) == 0 {
+		refreshToken = credentials.IdentityToken
+	}
+	var req *http.Request
+	var err error
+	if len(refreshToken) > 0 {
+		req, err = oauth2RefreshTokenRequest(source.realm, params, refreshToken)
+	} else {
+		req, err = basicTokenRequest(source.realm, params, credentials.UserName, credentials.Password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The token service of the registry host gets its client certificate
+	resp, err := client.Do(withRegistryEndpoint(req, auth.endpoint.host()))
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		body, err := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		username := credentials.UserName
+		password := credentials.Password
+		if req.Method != http.MethodGet || len(username) == 0 || len(password) == 0 {
+			return nil, fmt.Errorf("get token failed, %s", resp.Status)
+		}
+		req, err = oauth2PasswordTokenRequest(source.realm, params, username, password)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		type Token struct {
-			Token        string `json:"token"`
-			AccessToken  string `json:"access_token,omitempty"`
-			RefreshToken string `json:"refresh_token"`
-			ExpiresIn    int    `json:"expires_in"`
+		resp, err = client.Do(withRegistryEndpoint(req, auth.endpoint.host()))
+		if err != nil {
+			return nil, err
 		}
-		var token Token
-		if err := json.Unmarshal(body, &token); err != nil {
-			return err
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("get token failed, %s", resp.Status)
 		}
+	default:
+		return nil, fmt.Errorf("get token failed, %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
 
-		auth.token = token.Token
-	} else {
-		return fmt.Errorf("get token failed, %s", resp.Status)
+// setToken keeps the token and its expiry, the lock is held
+func (auth *endpointAuth) setToken(token *tokenResponse) {
+	auth.scheme = authSchemeBearer
+	auth.token = token.Token
+	if len(auth.token) == 0 {
+		auth.token = token.AccessToken
 	}
-	return nil
+	if len(token.RefreshToken) > 0 {
+		auth.refreshToken = token.RefreshToken
+	}
+	expiresIn := time.Duration(token.ExpiresIn) * time.Second
+	if expiresIn < minimumTokenLifetime {
+		expiresIn = minimumTokenLifetime
+	}
+	// The clock of the token server may differ, issued_at is only trusted when close
+	issuedAt := time.Now()
+	if !token.IssuedAt.IsZero() && token.IssuedAt.Before(issuedAt) && issuedAt.Sub(token.IssuedAt) < expiresIn {
+		issuedAt = token.IssuedAt
+	}
+	auth.expiresAt = issuedAt.Add(expiresIn)
+	auth.refreshErr = nil
+}
+
+// refresh gets a new token in the background, a failure is not tried
+// again before the backoff.
+func (auth *endpointAuth) refresh(source tokenSource) {
+	token, err := auth.requestToken(auth.httpClientCreate(), source)
+	auth.Lock()
+	defer auth.Unlock()
+	auth.refreshing = false
+	if err != nil {
+		auth.refreshErr = err
+		auth.refreshRetryAt = time.Now().Add(tokenRefreshBackoff)
+		return
+	}
+	auth.setToken(token)
+}
+
+// basicTokenRequest asks the token with the credentials, anonymously without them
+func basicTokenRequest(realm string, params url.Values, username string, password string) (*http.Request, error) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(username) > 0 && len(password) > 0 {
+		loginToken := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req.Header.Set(HeaderAuthorization, BasicTokenPrefix+loginToken)
+	}
+	return req, nil
+}
+
+// oauth2RefreshTokenRequest exchanges a refresh token, like the identity
+// token saved by docker login, for an access token.
+func oauth2RefreshTokenRequest(realm string, params url.Values, refreshToken string) (*http.Request, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	return oauth2TokenRequest(realm, params, form)
+}
+
+// oauth2PasswordTokenRequest asks an access token and a refresh token
+// with the credentials.
+func oauth2PasswordTokenRequest(realm string, params url.Values, username string, password string) (*http.Request, error) {
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("username", username)
+	form.Set("password", password)
+	form.Set("access_type", "offline")
+	return oauth2TokenRequest(realm, params, form)
+}
+
+func oauth2TokenRequest(realm string, params url.Values, form url.Values) (*http.Request, error) {
+	form.Set("client_id", oauth2ClientID)
+	form.Set("service", params.Get("service"))
+	if scope := params.Get("scope"); len(scope) > 0 {
+		form.Set("scope", scope)
+	}
+	req, err := http.NewRequest(http.MethodPost, realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HeaderContentType, "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// endpointRequest marks the request sent for the endpoint and
+// sets the headers of the endpoint config
+func (auth *endpointAuth) endpointRequest(req *http.Request) *http.Request {
+	req = withRegistryEndpoint(req, auth.endpoint.host())
+	for key, values := range auth.endpoint.header {
+		req.Header.Del(key)
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	return req
 }
 
-func (auth *Authenticator) Authorize(req *http.Request) error {
+// authorize sets the credentials of the request. The token about to expire
+// is refreshed in the background and still sent, once expired the registry
+// answers 401 and do gets a new one.
+func (auth *endpointAuth) authorize(req *http.Request) error {
 	if req == nil {
 		return fmt.Errorf("request object is nil")
 	}
-
-	if len(auth.token) > 0 {
-		req.Header.Set(HeaderAuthorization, BearerTokenPrefix+auth.token)
+	auth.Lock()
+	defer auth.Unlock()
+	switch auth.scheme {
+	case authSchemeBearer:
+		now := time.Now()
+		if now.Add(tokenExpiryMargin).After(auth.expiresAt) && !auth.refreshing && !now.Before(auth.refreshRetryAt) {
+			auth.refreshing = true
+			go auth.refresh(auth.tokenSource())
+		}
+		if len(auth.token) > 0 {
+			req.Header.Set(HeaderAuthorization, BearerTokenPrefix+auth.token)
+		}
+	case authSchemeBasic:
+		req.SetBasicAuth(auth.credentials.UserName, auth.credentials.Password)
 	}
 	return nil
 }
+
+// do sends the request with the credentials. The registry answers 401 once
+// the token expired or was revoked, the request is retried once after
+// a new challenge.
+func (auth *endpointAuth) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	req = auth.endpointRequest(req)
+	auth.authorize(req)
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenges := parseChallenges(resp.Header.Values(HeaderWWWAuthenticate))
+	resp.Body.Close()
+	if err := auth.rechallenge(client, req.Header.Get(HeaderAuthorization), challenges); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	retry.Header.Del(HeaderAuthorization)
+	auth.authorize(retry)
+	return client.Do(retry)
+}
+
+// rechallenge gets a new token from the challenge of a 401 response,
+// nothing is done if another request has refreshed the token meanwhile.
+func (auth *endpointAuth) rechallenge(client *http.Client, authorization string, challenges map[string]map[string]string) error {
+	auth.Lock()
+	defer auth.Unlock()
+	if auth.scheme == authSchemeBearer && len(authorization) > 0 && authorization != BearerTokenPrefix+auth.token {
+		return nil
+	}
+	// The requests which got 401 meanwhile don't ask the token again
+	if auth.refreshErr != nil && time.Now().Before(auth.refreshRetryAt) {
+		return auth.refreshErr
+	}
+	if bearer, ok := challenges[authSchemeBearer]; ok {
+		if realm := bearer["realm"]; len(realm) > 0 {
+			auth.realm = realm
+			auth.service = bearer["service"]
+		}
+		if len(auth.realm) == 0 {
+			return fmt.Errorf("auth endpoint not found")
+		}
+		err := auth.fetchToken(client)
+		// The refresh token may be the revoked credential
+		if err != nil && len(auth.refreshToken) > 0 {
+			auth.refreshToken = ""
+			err = auth.fetchToken(client)
+		}
+		if err != nil {
+			auth.refreshErr = err
+			auth.refreshRetryAt = time.Now().Add(tokenRefreshBackoff)
+		}
+		return err
+	}
+	if _, ok := challenges[authSchemeBasic]; ok {
+		if auth.scheme == authSchemeBasic {
+			return fmt.Errorf("basic auth failed, %s", http.StatusText(http.StatusUnauthorized))
+		}
+		return auth.basicAuth(client, auth.endpoint.apiURL()+"/")
+	}
+	return fmt.Errorf("auth endpoint not found")
+}
+
+// parseChallenges returns the parameters of the WWW-Authenticate challenges
+// by their lower case scheme. A scheme may come without parameters, like
+// Basic, and the values may be quoted or not.
+func parseChallenges(headers []string) map[string]map[string]string {
+	challenges := map[string]map[string]string{}
+	// WWW-Authenticate can have multiple values, each containing multiple challenges
+	for _, h := range headers {
+		var params map[string]string
+		for _, item := range splitChallengeItems(h) {
+			// An item not starting with key= begins a challenge, its first parameter follows the scheme
+			if !isChallengeParam(item) {
+				scheme, rest, _ := strings.Cut(item, " ")
+				params = map[string]string{}
+				challenges[strings.ToLower(scheme)] = params
+				item = strings.TrimSpace(rest)
+			}
+			key, value, ok := strings.Cut(item, "=")
+			// A token68, like the data of Negotiate, is not used
+			if !ok || params == nil || (len(value) > 0 && len(strings.Trim(value, "=")) == 0) {
+				continue
+			}
+			params[strings.ToLower(strings.TrimSpace(key))] = unquoteChallengeValue(strings.TrimSpace(value))
+		}
+	}
+	return challenges
+}
+
+// splitChallengeItems splits a header on the commas out of the quoted strings
+func splitChallengeItems(h string) []string {
+	var items []string
+	var item strings.Builder
+	quoted, escaped := false, false
+	for _, r := range h {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			if trimmed := strings.TrimSpace(item.String()); len(trimmed) > 0 {
+				items = append(items, trimmed)
+			}
+			item.Reset()
+			continue
+		}
+		item.WriteRune(r)
+	}
+	if trimmed := strings.TrimSpace(item.String()); len(trimmed) > 0 {
+		items = append(items, trimmed)
+	}
+	return items
+}
+
+// isChallengeParam tells if the item is key=value rather than a scheme
+func isChallengeParam(item string) bool {
+	key, _, ok := strings.Cut(item, "=")
+	return ok && !strings.ContainsAny(strings.TrimSpace(key), " \t")
+}
+
+func unquoteChallengeValue(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	var result strings.Builder
+	escaped := false
+	for _, r := range value[1 : len(value)-1] {
+		if !escaped && r == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		result.WriteRune(r)
+	}
+	return result.String()
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    map[string]map[string]string
+	}{
+		{
+			name:    "bearer",
+			headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`},
+			want: map[string]map[string]string{
+				"bearer": {"realm": "https://auth.docker.io/token", "service": "registry.docker.io"},
+			},
+		},
+		{
+			name:    "quoted comma",
+			headers: []string{`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:a/b:pull,push"`},
+			want: map[string]map[string]string{
+				"bearer": {"realm": "https://ghcr.io/token", "service": "ghcr.io", "scope": "repository:a/b:pull,push"},
+			},
+		},
+		{
+			name:    "bare basic",
+			headers: []string{`Basic`},
+			want:    map[string]map[string]string{"basic": {}},
+		},
+		{
+			name:    "basic realm",
+			headers: []string{`Basic realm="Registry Realm"`},
+			want:    map[string]map[string]string{"basic": {"realm": "Registry Realm"}},
+		},
+		{
+			name:    "unquoted",
+			headers: []string{`Bearer realm=https://registry.example.com/token, service=registry.example.com`},
+			want: map[string]map[string]string{
+				"bearer": {"realm": "https://registry.example.com/token", "service": "registry.example.com"},
+			},
+		},
+		{
+			name:    "spaces around equals",
+			headers: []string{`Basic realm = "harbor"`},
+			want:    map[string]map[string]string{"basic": {"realm": "harbor"}},
+		},
+		{
+			name:    "escaped quote",
+			headers: []string{`Basic realm="a \"quoted\" realm"`},
+			want:    map[string]map[string]string{"basic": {"realm": `a "quoted" realm`}},
+		},
+		{
+			name:    "case",
+			headers: []string{`BEARER Realm="https://auth.example.com/token"`},
+			want:    map[string]map[string]string{"bearer": {"realm": "https://auth.example.com/token"}},
+		},
+		{
+			name:    "several challenges in one value",
+			headers: []string{`Basic, Bearer realm="https://auth.example.com/token",service="example"`},
+			want: map[string]map[string]string{
+				"basic":  {},
+				"bearer": {"realm": "https://auth.example.com/token", "service": "example"},
+			},
+		},
+		{
+			name:    "several values",
+			headers: []string{`Negotiate`, `Bearer realm="https://auth.example.com/token"`, `Basic realm="example"`},
+			want: map[string]map[string]string{
+				"negotiate": {},
+				"bearer":    {"realm": "https://auth.example.com/token"},
+				"basic":     {"realm": "example"},
+			},
+		},
+		{
+			name:    "token68",
+			headers: []string{`Negotiate YIIBhwYGKwYBBQUCoIIBezCCAXeg==`},
+			want:    map[string]map[string]string{"negotiate": {}},
+		},
+		{
+			name:    "empty",
+			headers: []string{``, ` , `},
+			want:    map[string]map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseChallenges(tt.headers)
+			if !maps.EqualFunc(got, tt.want, maps.Equal) {
+				t.Errorf("parseChallenges(%q) = %v, want %v", tt.headers, got, tt.want)
+			}
+		})
+	}
+}
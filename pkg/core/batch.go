@@ -0,0 +1,126 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+)
+
+type batchResult struct {
+	image      string
+	outputFile string
+	size       int64
+	err        error
+}
+
+// batchOutputFile names the tar after the image and the platform of the entry,
+// nginx:1.25 is saved in nginx_1.25.tar and in nginx_1.25_arm64v8.tar with arch arm64v8.
+func batchOutputFile(image cli.BatchImage) string {
+	if len(image.OutputFile) > 0 {
+		return image.OutputFile
+	}
+	platform := image.Platform
+	if len(platform) == 0 {
+		platform = image.Architecture
+	}
+	if len(platform) == 0 {
+		return defaultOutputFile([]string{image.Image})
+	}
+	return outputFileReplacer.Replace(image.Image+"_"+platform) + ".tar"
+}
+
+// checkBatchOutputFiles rejects the entries saved in the same tar,
+// the last one pulled would overwrite the others.
+func checkBatchOutputFiles(images []cli.BatchImage) error {
+	seen := map[string]string{}
+	for _, image := range images {
+		outputFile := filepath.Clean(batchOutputFile(image))
+		if previous, ok := seen[outputFile]; ok {
+			return fmt.Errorf("%s and %s are both saved in %s, set another output for one of them",
+				previous, image.Image, outputFile)
+		}
+		seen[outputFile] = image.Image
+	}
+	return nil
+}
+
+// batchPullAction pulls every image of the batch file in its own tar,
+// a failed image doesn't stop the others.
+func batchPullAction(config *cli.Config) {
+	images, err := cli.ReadBatchFile(config.BatchFile())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := checkBatchOutputFiles(images); err != nil {
+		fmt.Println(err)
+		return
+	}
+	pool := NewHttpClientPool()
+	results := make([]batchResult, len(images))
+	for i, image := range images {
+		imageConfig := config.Clone()
+		imageConfig.SetBatchFile("")
+		imageConfig.SetImages(nil)
+		imageConfig.SetImageInfo(image.Image)
+		if len(image.Architecture) > 0 {
+			imageConfig.SetArchitecture(image.Architecture)
+			imageConfig.SetPlatform("")
+		}
+		if len(image.Platform) > 0 {
+			imageConfig.SetPlatform(image.Platform)
+		}
+		outputFile := batchOutputFile(image)
+		imageConfig.SetOutputFile(outputFile)
+		if len(image.UserName) > 0 {
+			imageConfig.SetUserNamePassword(image.UserName, image.Password)
+		}
+		fmt.Printf("[%d/%d] %s\n", i+1, len(images), image.Image)
+		results[i] = batchResult{
+			image:      image.Image,
+			outputFile: outputFile,
+			err:        pull(imageConfig, pool),
+		}
+		if results[i].err == nil {
+			if fi, err := os.Stat(outputFile); err == nil {
+				results[i].size = fi.Size()
+			}
+		}
+	}
+	printBatchSummary(results)
+}
+
+func printBatchSummary(results []batchResult) {
+	var succeeded int
+	var totalSize int64
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tSTATUS\tSIZE\tOUTPUT")
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Fprintf(tw, "%s\tFAILED\t-\t%v\n", result.image, result.err)
+			continue
+		}
+		succeeded++
+		totalSize += result.size
+		fmt.Fprintf(tw, "%s\tOK\t%s\t%s\n", result.image, humanSize(result.size), result.outputFile)
+	}
+	tw.Flush()
+	fmt.Printf("%d succeeded, %d failed, %s in total\n",
+		succeeded, len(results)-succeeded, humanSize(totalSize))
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
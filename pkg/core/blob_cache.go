@@ -0,0 +1,300 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+	"github.com/opencontainers/go-digest"
+)
+
+var errCachedBlobCorrupted = errors.New("cached blob does not match its digest")
+
+// Temporary files older than this are left by a crashed process
+const staleCacheTempAge = 24 * time.Hour
+
+// BlobCache is a content-addressable store of the blobs pulled before,
+// shared by every docker-tar process of the user.
+// Blobs are written to a temporary file and renamed into place once verified,
+// so a reader never sees a partial blob.
+type BlobCache struct {
+	cacheDir string
+	maxSize  int64
+	// The cache is disabled, cacheDir only holds the blobs of this pull
+	scratch bool
+
+	initialized bool
+}
+
+type BlobCacheWriter struct {
+	file     *os.File
+	digest   digest.Digest
+	verifier digest.Verifier
+	cache    *BlobCache
+	err      error
+}
+
+func (cache *BlobCache) Initialize(entry *EntryPoint) {
+	if entry == nil {
+		panic("BlobCache init failed, EntryPoint is nil")
+	}
+	cache.initialized = true
+}
+
+func (cache *BlobCache) InitializeCheck() {
+	if cache.initialized {
+		return
+	}
+	panic("BlobCache not init")
+}
+
+func (cache *BlobCache) Run() error {
+	return cache.Prune()
+}
+
+func (cache *BlobCache) ApplyConfig(config *cli.Config) error {
+	if config == nil {
+		return fmt.Errorf("blobCache: ApplyConfig Failed, Config object is nil")
+	}
+	cache.maxSize = config.CacheSize() << 20
+	if config.CacheDisabled() {
+		return nil
+	}
+	cacheDir := config.CacheDir()
+	if len(cacheDir) == 0 {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil
+		}
+		cacheDir = filepath.Join(userCacheDir, "docker-tar")
+	}
+	cache.cacheDir = cacheDir
+	return nil
+}
+
+func (cache *BlobCache) Enabled() bool {
+	return len(cache.cacheDir) > 0
+}
+
+// UseScratchDir keeps the blobs in a temporary directory when the cache is
+// disabled, a blob read twice by the pull is only downloaded once.
+func (cache *BlobCache) UseScratchDir() error {
+	if cache.Enabled() {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "docker-tar-blobs-")
+	if err != nil {
+		return err
+	}
+	cache.cacheDir = dir
+	cache.scratch = true
+	return nil
+}
+
+// RemoveScratchDir removes the temporary directory, the cache is disabled again
+func (cache *BlobCache) RemoveScratchDir() {
+	if !cache.scratch {
+		return
+	}
+	os.RemoveAll(cache.cacheDir)
+	cache.cacheDir = ""
+	cache.scratch = false
+}
+
+func (cache *BlobCache) blobsDir() string {
+	return filepath.Join(cache.cacheDir, "blobs")
+}
+
+func (cache *BlobCache) tempDir() string {
+	return filepath.Join(cache.cacheDir, "tmp")
+}
+
+func (cache *BlobCache) blobPath(d digest.Digest) string {
+	return filepath.Join(cache.blobsDir(), d.Algorithm().String(), d.Encoded())
+}
+
+// Open returns the cached blob, the access time used by Prune is refreshed.
+func (cache *BlobCache) Open(d digest.Digest) (*os.File, bool) {
+	if !cache.Enabled() || d.Validate() != nil {
+		return nil, false
+	}
+	blobPath := cache.blobPath(d)
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(blobPath, now, now)
+	return f, true
+}
+
+// ReadAll returns the cached blob if it matches its digest.
+func (cache *BlobCache) ReadAll(d digest.Digest) ([]byte, bool) {
+	f, ok := cache.Open(d)
+	if !ok {
+		return nil, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, false
+	}
+	if d.Algorithm().FromBytes(data) != d {
+		f.Close()
+		cache.Remove(d)
+		return nil, false
+	}
+	return data, true
+}
+
+func (cache *BlobCache) Remove(d digest.Digest) {
+	if !cache.Enabled() || d.Validate() != nil {
+		return
+	}
+	os.Remove(cache.blobPath(d))
+}
+
+// Create returns a writer which adds the blob to the cache on Commit.
+func (cache *BlobCache) Create(d digest.Digest) (*BlobCacheWriter, error) {
+	if !cache.Enabled() {
+		return nil, fmt.Errorf("blob cache is disabled")
+	}
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cache.tempDir(), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(cache.tempDir(), d.Encoded()+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &BlobCacheWriter{
+		file:     f,
+		digest:   d,
+		verifier: d.Verifier(),
+		cache:    cache,
+	}, nil
+}
+
+// Store adds a blob read in memory to the cache.
+func (cache *BlobCache) Store(d digest.Digest, data []byte) error {
+	w, err := cache.Create(d)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	return w.Commit()
+}
+
+// Write never fails, a broken cache must not break the pull.
+// The error is reported by Commit instead.
+func (w *BlobCacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.file.Write(p)
+	}
+	w.verifier.Write(p)
+	return len(p), nil
+}
+
+func (w *BlobCacheWriter) Commit() error {
+	tempName := w.file.Name()
+	if err := w.file.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		os.Remove(tempName)
+		return w.err
+	}
+	if !w.verifier.Verified() {
+		os.Remove(tempName)
+		return fmt.Errorf("blob %s: content does not match digest", w.digest)
+	}
+	blobPath := w.cache.blobPath(w.digest)
+	if err := os.MkdirAll(filepath.Dir(blobPath), os.ModePerm); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	// Another process may store the same blob, the content is identical
+	if err := os.Rename(tempName, blobPath); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return nil
+}
+
+func (w *BlobCacheWriter) Discard() {
+	tempName := w.file.Name()
+	w.file.Close()
+	os.Remove(tempName)
+}
+
+// Prune removes the least recently used blobs until the cache
+// fits in the configured size.
+func (cache *BlobCache) Prune() error {
+	if !cache.Enabled() {
+		return nil
+	}
+	type cachedBlob struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+	var blobs []cachedBlob
+	var totalSize int64
+	err := filepath.Walk(cache.blobsDir(), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		blobs = append(blobs, cachedBlob{
+			path:    path,
+			size:    fi.Size(),
+			lastUse: fi.ModTime(),
+		})
+		totalSize += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].lastUse.Before(blobs[j].lastUse)
+	})
+	for _, blob := range blobs {
+		if totalSize <= cache.maxSize {
+			break
+		}
+		// A blob still opened by another process may fail to be removed on Windows
+		if err := os.Remove(blob.path); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		totalSize -= blob.size
+	}
+	entries, err := os.ReadDir(cache.tempDir())
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleCacheTempAge {
+			continue
+		}
+		os.Remove(filepath.Join(cache.tempDir(), entry.Name()))
+	}
+	return nil
+}
+
+func (cache *BlobCache) CacheDir() string {
+	return cache.cacheDir
+}
@@ -6,7 +6,47 @@ const (
 	HeaderContentType     = "Content-Type"
 	HeaderWWWAuthenticate = "WWW-Authenticate"
 	HeaderAccept          = "Accept"
+	HeaderRange           = "Range"
+	HeaderContentRange    = "Content-Range"
+	HeaderRetryAfter      = "Retry-After"
+)
+
+// The pull rate limit headers of Docker Hub
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitSource    = "Docker-RateLimit-Source"
 )
 
 const BearerTokenPrefix = "Bearer "
 const BasicTokenPrefix = "Basic "
+
+const (
+	FormatDocker = "docker"
+	FormatOCI    = "oci"
+)
+
+// AnnotationImageName is read by containerd and docker load to tag an OCI image
+const AnnotationImageName = "io.containerd.image.name"
+
+// AllArchitectures selects every architecture of the image index
+const AllArchitectures = "all"
+
+// Media types of the docker distribution, the OCI ones are in image-spec
+const (
+	MediaTypeDockerManifestList          = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest              = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerSchema1Manifest       = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeDockerSchema1SignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MediaTypeDockerImageConfig           = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer                 = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// Annotations of the attestation manifests added by buildx to the image index
+const (
+	AnnotationReferenceType   = "vnd.docker.reference.type"
+	AnnotationReferenceDigest = "vnd.docker.reference.digest"
+	AnnotationPredicateType   = "in-toto.io/predicate-type"
+
+	ReferenceTypeAttestation = "attestation-manifest"
+)
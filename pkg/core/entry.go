@@ -1,12 +1,17 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
 	chinadns "github.com/excitedplus1s/gfwutils/dns"
 	chinahttp "github.com/excitedplus1s/gfwutils/http"
+	"github.com/opencontainers/go-digest"
 )
 
 type Runner interface {
@@ -72,14 +77,22 @@ func FRun11[A1, R1 any](r Runner, f func(A1) error, arg1 A1) func() error {
 	}
 }
 
-func RunLoopWithPrintln(fns []func() error) {
+// RunLoop stops at the first error, the caller prints it
+func RunLoop(fns []func() error) error {
 	for _, fn := range fns {
-		err := fn()
-		if err != nil {
-			fmt.Println(err)
-			break
+		if err := fn(); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func RunLoopWithPrintln(fns []func() error) error {
+	err := RunLoop(fns)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
 }
 
 func Run12[A1, R1, R2 any](r Runner, f func(A1) (R1, R2), arg1 A1) (R1, R2) {
@@ -91,6 +104,8 @@ type HttpClientFn func() *http.Client
 
 type EntryPoint struct {
 	HttpClientFnPtr *HttpClientFn
+	// Optional, the clients are shared with the other entries when set
+	HttpClientPool *HttpClientPool
 
 	Authenticator          *Authenticator
 	ImageInfoManager       *ImageInfoManager
@@ -101,12 +116,21 @@ type EntryPoint struct {
 	ImageConfigBlobFetcher *ImageConfigBlobFetcher
 	ImageContentCollector  *ImageContentCollector
 	LayerDownloader        *LayerDownloader
+	AttestationFetcher     *AttestationFetcher
+	BlobCache              *BlobCache
 }
 
-func (s *EntryPoint) ApplyConfig(config *cli.Config) error {
-	if config == nil {
-		return fmt.Errorf("imageConfigBlobFetcher: WriteToFile Failed, EntryPoint object is nil")
-	}
+// A registry which accepts the connection and never answers is given up
+// after these, the next endpoint is tried then
+const (
+	dialTimeout           = 30 * time.Second
+	tlsHandshakeTimeout   = 10 * time.Second
+	responseHeaderTimeout = 30 * time.Second
+	idleConnTimeout       = 90 * time.Second
+)
+
+// newHttpClientFn creates the clients with the experimental features of the config
+func newHttpClientFn(config *cli.Config) HttpClientFn {
 	var dnsConfig *chinadns.Config
 	var httpConfig *chinahttp.Config
 	var resolverCache = map[string][]string{}
@@ -121,67 +145,315 @@ func (s *EntryPoint) ApplyConfig(config *cli.Config) error {
 			AnticensorEnabled: true,
 		}
 	}
-	var httpClientFn HttpClientFn = func() *http.Client {
-		return chinahttp.Client(dnsConfig, httpConfig)
+	attempts := config.Retries() + 1
+	retryWait := config.RetryWait()
+	proxy := proxyFunc(config.ProxyURL())
+	labWarnings := &sync.Map{}
+	newTransport := func(client *http.Client) http.RoundTripper {
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		if httpTransport, ok := transport.(*http.Transport); ok {
+			// http.DefaultTransport must not be changed
+			httpTransport = httpTransport.Clone()
+			// The proxied requests don't use the uTLS dialer of the lab mode
+			httpTransport.Proxy = proxy
+			if dnsConfig != nil {
+				httpTransport.DialContext = labDialContext(dnsConfig)
+			}
+			if httpTransport.DialContext == nil {
+				httpTransport.DialContext = (&net.Dialer{
+					Timeout:   dialTimeout,
+					KeepAlive: 30 * time.Second,
+				}).DialContext
+			}
+			// The uTLS dialer of the lab mode has no timeout of its own
+			if dialTLS := httpTransport.DialTLSContext; dialTLS != nil {
+				httpTransport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+					ctx, cancel := context.WithTimeout(ctx, dialTimeout+tlsHandshakeTimeout)
+					defer cancel()
+					return dialTLS(ctx, network, addr)
+				}
+			}
+			if httpTransport.TLSHandshakeTimeout == 0 {
+				httpTransport.TLSHandshakeTimeout = tlsHandshakeTimeout
+			}
+			if httpTransport.IdleConnTimeout == 0 {
+				httpTransport.IdleConnTimeout = idleConnTimeout
+			}
+			httpTransport.ResponseHeaderTimeout = responseHeaderTimeout
+			transport = httpTransport
+		}
+		return &registryTransport{
+			base:        transport,
+			registryTLS: config.RegistryTLS,
+			labWarnings: labWarnings,
+		}
+	}
+	// Not lab mode returns http.DefaultClient, its connections are shared
+	var sharedTransport http.RoundTripper
+	if dnsConfig == nil {
+		sharedTransport = newTransport(chinahttp.Client(nil, nil))
+	}
+	return func() *http.Client {
+		client := chinahttp.Client(dnsConfig, httpConfig)
+		transport := sharedTransport
+		if transport == nil {
+			transport = newTransport(client)
+		}
+		return &http.Client{
+			Transport: &RetryTransport{
+				Base:     transport,
+				Attempts: attempts,
+				Wait:     retryWait,
+			},
+			CheckRedirect: client.CheckRedirect,
+			Jar:           client.Jar,
+			Timeout:       client.Timeout,
+		}
+	}
+}
+
+func (s *EntryPoint) ApplyConfig(config *cli.Config) error {
+	if config == nil {
+		return fmt.Errorf("imageConfigBlobFetcher: WriteToFile Failed, EntryPoint object is nil")
+	}
+	httpClientFn := newHttpClientFn(config)
+	if s.HttpClientPool != nil {
+		pool := s.HttpClientPool
+		createClient := httpClientFn
+		httpClientFn = func() *http.Client {
+			return pool.Client(s.RequestInfoManager.RegistryEndpoint(), createClient)
+		}
 	}
 	s.HttpClientFnPtr = &httpClientFn
-	s.Authenticator = new(Authenticator)
+	// The platforms of an image keep the auth and the index of the first entry
+	sharedIndex := s.Authenticator != nil && s.ImageIndexFetcher != nil
+	if !sharedIndex {
+		s.Authenticator = new(Authenticator)
+		s.ImageIndexFetcher = new(ImageIndexFetcher)
+	}
 	s.ImageInfoManager = new(ImageInfoManager)
 	s.RequestInfoManager = new(RequestInfoManager)
-	s.ImageIndexFetcher = new(ImageIndexFetcher)
 	s.OutputFileManager = new(OutputFileManager)
 	s.ImageConfigFetcher = new(ImageConfigFetcher)
 	s.ImageConfigBlobFetcher = new(ImageConfigBlobFetcher)
 	s.ImageContentCollector = new(ImageContentCollector)
 	s.LayerDownloader = new(LayerDownloader)
+	s.AttestationFetcher = new(AttestationFetcher)
+	s.BlobCache = new(BlobCache)
 	var initializes = []Runner{
-		s.Authenticator,
 		s.ImageInfoManager,
 		s.RequestInfoManager,
-		s.ImageIndexFetcher,
 		s.OutputFileManager,
 		s.ImageConfigFetcher,
 		s.ImageConfigBlobFetcher,
 		s.ImageContentCollector,
 		s.LayerDownloader,
+		s.AttestationFetcher,
+		s.BlobCache,
+	}
+	if !sharedIndex {
+		initializes = append(initializes, s.Authenticator, s.ImageIndexFetcher)
 	}
 	for _, init := range initializes {
 		init.Initialize(s)
 	}
-	s.ImageInfoManager.ApplyConfig(config)
-	s.RequestInfoManager.ApplyConfig(config)
-	s.OutputFileManager.ApplyConfig(config)
+	var applyConfigs = []func(*cli.Config) error{
+		s.ImageInfoManager.ApplyConfig,
+		s.RequestInfoManager.ApplyConfig,
+		s.ImageConfigFetcher.ApplyConfig,
+		s.OutputFileManager.ApplyConfig,
+		s.LayerDownloader.ApplyConfig,
+		s.AttestationFetcher.ApplyConfig,
+		s.BlobCache.ApplyConfig,
+	}
+	if !sharedIndex {
+		applyConfigs = append(applyConfigs, s.ImageIndexFetcher.ApplyConfig)
+	}
+	for _, applyConfig := range applyConfigs {
+		if err := applyConfig(config); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func listArchAction(config *cli.Config) {
 	entry := &EntryPoint{}
-	entry.ApplyConfig(config)
+	if err := entry.ApplyConfig(config); err != nil {
+		fmt.Println(err)
+		return
+	}
 	listFns := []func() error{FRun(entry.Authenticator),
 		FRun(entry.ImageIndexFetcher),
 	}
 	RunLoopWithPrintln(listFns)
-	availableArch := Run01(entry.ImageIndexFetcher, entry.ImageIndexFetcher.AvailableArch)
-	fmt.Println("Available Architecture:")
-	for _, arch := range availableArch {
-		fmt.Println(arch)
+	availablePlatforms := Run01(entry.ImageIndexFetcher, entry.ImageIndexFetcher.AvailablePlatforms)
+	fmt.Println("Available Platforms:")
+	for _, platform := range availablePlatforms {
+		fmt.Println(platform)
 	}
 }
 
-func pullAction(config *cli.Config) {
-	entry := &EntryPoint{}
-	entry.ApplyConfig(config)
-	pullFns := []func() error{FRun(entry.Authenticator),
+// pullImage pulls the platforms of one image into the staging folder
+func pullImage(config *cli.Config, pool *HttpClientPool, merger *ImageArchiveMerger, multiArch bool) error {
+	entry := &EntryPoint{HttpClientPool: pool}
+	if err := entry.ApplyConfig(config); err != nil {
+		return err
+	}
+	indexFns := []func() error{FRun(entry.Authenticator),
 		FRun(entry.ImageIndexFetcher),
-		FRun(entry.ImageConfigFetcher),
-		FRun(entry.ImageConfigBlobFetcher),
-		FRun(entry.ImageContentCollector),
-		FRun(entry.OutputFileManager),
-		FRun(entry.LayerDownloader),
-		FRun01(entry.OutputFileManager, entry.OutputFileManager.ChtimesAll),
-		FRun01(entry.OutputFileManager, entry.OutputFileManager.TarImage),
 	}
-	RunLoopWithPrintln(pullFns)
+	if err := RunLoop(indexFns); err != nil {
+		return err
+	}
+	imageIndex := entry.ImageIndexFetcher
+	platforms, err := Run12(imageIndex, imageIndex.SelectPlatforms, config.Platforms())
+	if err != nil {
+		return err
+	}
+	if multiArch {
+		content, descriptor, ok := imageIndex.ImageIndex()
+		if ok && imageIndex.ImageIndexCoveredBy(platforms, config.Attestations()) {
+			if err := merger.KeepImageIndex(entry.ImageInfoManager, content, descriptor); err != nil {
+				return err
+			}
+		}
+	}
+	for _, platform := range platforms {
+		// The index is pulled already, a platform only gets its manifest
+		archEntry := entry
+		if multiArch {
+			archConfig := config.Clone()
+			archConfig.SetPlatform(platform)
+			archEntry = &EntryPoint{
+				HttpClientPool:    pool,
+				Authenticator:     entry.Authenticator,
+				ImageIndexFetcher: entry.ImageIndexFetcher,
+			}
+			if err := archEntry.ApplyConfig(archConfig); err != nil {
+				return err
+			}
+		}
+		pullFns := []func() error{FRun(archEntry.ImageConfigFetcher),
+			FRun(archEntry.ImageConfigBlobFetcher),
+			FRun(archEntry.ImageContentCollector),
+			FRun(archEntry.OutputFileManager),
+			FRun(archEntry.LayerDownloader),
+			FRun(archEntry.AttestationFetcher),
+		}
+		if multiArch {
+			fmt.Println("Platform:", platform)
+		}
+		err := RunLoop(pullFns)
+		// The layers of a schema1 image pulled without the cache
+		archEntry.BlobCache.RemoveScratchDir()
+		if err != nil {
+			return err
+		}
+		reportServedBlobs(archEntry)
+		merger.Add(archEntry)
+	}
+	return nil
+}
+
+// reportServedBlobs tells which endpoint served each blob when mirrors are used,
+// local is a blob of the cache or of a previous run.
+func reportServedBlobs(entry *EntryPoint) {
+	if len(entry.RequestInfoManager.RegistryEndpoints()) < 2 {
+		return
+	}
+	imageConfig := entry.ImageConfigFetcher
+	blobDigests := append([]digest.Digest{imageConfig.ConfigDigest()}, imageConfig.BlobDigests()...)
+	seen := map[digest.Digest]bool{}
+	fmt.Println("Blob Sources:")
+	for _, blobDigest := range blobDigests {
+		if seen[blobDigest] || blobDigest.Validate() != nil {
+			continue
+		}
+		seen[blobDigest] = true
+		endpoint, ok := entry.Authenticator.ServedBy(blobDigest)
+		if !ok {
+			endpoint = "local"
+		}
+		fmt.Printf("%s: %s\n", blobDigest.Encoded()[:12], endpoint)
+	}
+}
+
+// pull saves the images of the config in its output file,
+// the error is printed by the caller
+func pull(config *cli.Config, pool *HttpClientPool) error {
+	// Every image is pulled into the same staging folder
+	if len(config.OutputFile()) == 0 {
+		config.SetOutputFile(defaultOutputFile(config.Images()))
+	}
+	blobCache, err := newBlobCache(config)
+	if err != nil {
+		return err
+	}
+	platforms := config.Platforms()
+	multiArch := len(platforms) > 1 || (len(platforms) == 1 && platforms[0] == AllArchitectures)
+	if multiArch && config.Format() != FormatOCI {
+		fmt.Println("Multi-architecture image is saved in the oci format")
+		config.SetFormat(FormatOCI)
+	}
+	if config.Attestations() && config.Format() != FormatOCI {
+		fmt.Println("Attestations are saved in the oci format")
+		config.SetFormat(FormatOCI)
+	}
+	images := config.Images()
+	if len(images) == 0 {
+		return fmt.Errorf("no image to pull")
+	}
+	merger := &ImageArchiveMerger{}
+	for _, image := range images {
+		imageConfig := config.Clone()
+		imageConfig.SetImages(nil)
+		imageConfig.SetImageInfo(image)
+		if err := pullImage(imageConfig, pool, merger, multiArch); err != nil {
+			return err
+		}
+	}
+	mergeFns := []func() error{merger.WriteToFile,
+		merger.ChtimesAll,
+		merger.CleanFloder,
+		merger.TarImage,
+		FRun(blobCache),
+	}
+	return RunLoop(mergeFns)
+}
+
+func pullAction(config *cli.Config) {
+	if len(config.BatchFile()) > 0 {
+		batchPullAction(config)
+		return
+	}
+	if err := pull(config, NewHttpClientPool()); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// newBlobCache builds the cache alone, the actions using it without an
+// image don't apply the config of a whole entry
+func newBlobCache(config *cli.Config) (*BlobCache, error) {
+	blobCache := new(BlobCache)
+	blobCache.Initialize(&EntryPoint{BlobCache: blobCache})
+	if err := blobCache.ApplyConfig(config); err != nil {
+		return nil, err
+	}
+	return blobCache, nil
+}
+
+func pruneAction(config *cli.Config) {
+	blobCache, err := newBlobCache(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	pruneFns := []func() error{FRun(blobCache)}
+	RunLoopWithPrintln(pruneFns)
 }
 
 func Eval(config *cli.Config) {
@@ -191,6 +463,14 @@ func Eval(config *cli.Config) {
 		pullAction(config)
 	case "list":
 		listArchAction(config)
+	case "prune":
+		pruneAction(config)
+	case "login":
+		loginAction(config)
+	case "logout":
+		logoutAction(config)
+	case "ratelimit":
+		rateLimitAction(config)
 	default:
 		fmt.Println("Action not support:", action)
 	}
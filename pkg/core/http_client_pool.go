@@ -0,0 +1,60 @@
+package core
+
+import (
+	"net/http"
+	"sync"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+)
+
+// HttpClientPool shares one client per registry between the entries of
+// a pull, the connections and the resolved addresses are reused. The auth
+// state of the endpoints is shared too, the images of a repository don't
+// ask a token again.
+type HttpClientPool struct {
+	sync.Mutex
+	clients map[string]*http.Client
+	auths   map[endpointAuthKey]*endpointAuth
+}
+
+// endpointAuthKey tells the auth states apart, the tokens are scoped to
+// the repository and the batch images may have their own credentials.
+type endpointAuthKey struct {
+	url         string
+	repository  string
+	credentials cli.Credentials
+}
+
+func NewHttpClientPool() *HttpClientPool {
+	return &HttpClientPool{
+		clients: map[string]*http.Client{},
+		auths:   map[endpointAuthKey]*endpointAuth{},
+	}
+}
+
+func (pool *HttpClientPool) Client(registryEndpoint string, create HttpClientFn) *http.Client {
+	pool.Lock()
+	defer pool.Unlock()
+	client, ok := pool.clients[registryEndpoint]
+	if !ok {
+		client = create()
+		pool.clients[registryEndpoint] = client
+	}
+	return client
+}
+
+// endpointAuth returns the auth state of the endpoint, created on first use
+func (pool *HttpClientPool) endpointAuth(auth *endpointAuth) *endpointAuth {
+	pool.Lock()
+	defer pool.Unlock()
+	key := endpointAuthKey{
+		url:         auth.endpoint.url,
+		repository:  auth.endpoint.repository,
+		credentials: auth.credentials,
+	}
+	if shared, ok := pool.auths[key]; ok {
+		return shared
+	}
+	pool.auths[key] = auth
+	return auth
+}
@@ -0,0 +1,265 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImageArchiveMerger writes the files shared by every image of an archive,
+// the images are pulled by their own EntryPoint into the same staging folder.
+type ImageArchiveMerger struct {
+	entries []*EntryPoint
+
+	// The image indexes as pulled, kept for a multi-architecture archive
+	imageIndexes []keptImageIndex
+}
+
+type keptImageIndex struct {
+	imageInfo  *ImageInfoManager
+	content    []byte
+	descriptor v1.Descriptor
+	manifests  map[digest.Digest]bool
+}
+
+type archiveFile struct {
+	open  func() (*os.File, error)
+	value any
+}
+
+func (merger *ImageArchiveMerger) Add(entry *EntryPoint) {
+	merger.entries = append(merger.entries, entry)
+}
+
+// KeepImageIndex makes index.json point to the original image index
+// instead of listing the manifests pulled for this image.
+func (merger *ImageArchiveMerger) KeepImageIndex(imageInfo *ImageInfoManager, content []byte, descriptor v1.Descriptor) error {
+	var index v1.Index
+	if err := json.Unmarshal(content, &index); err != nil {
+		return err
+	}
+	manifests := map[digest.Digest]bool{}
+	for _, manifest := range index.Manifests {
+		manifests[manifest.Digest] = true
+	}
+	merger.imageIndexes = append(merger.imageIndexes, keptImageIndex{
+		imageInfo:  imageInfo,
+		content:    content,
+		descriptor: descriptor,
+		manifests:  manifests,
+	})
+	return nil
+}
+
+// keptImageIndex returns the image index which lists the manifest of the entry
+func (merger *ImageArchiveMerger) keptImageIndex(entry *EntryPoint) (keptImageIndex, bool) {
+	for _, imageIndex := range merger.imageIndexes {
+		if imageIndex.imageInfo.CanonicalName() != entry.ImageInfoManager.CanonicalName() {
+			continue
+		}
+		if imageIndex.manifests[entry.ImageConfigFetcher.ManifestDescriptor().Digest] {
+			return imageIndex, true
+		}
+	}
+	return keptImageIndex{}, false
+}
+
+func (merger *ImageArchiveMerger) output() (*OutputFileManager, error) {
+	if len(merger.entries) == 0 {
+		return nil, fmt.Errorf("no image pulled")
+	}
+	return merger.entries[0].OutputFileManager, nil
+}
+
+func (merger *ImageArchiveMerger) WriteToFile() error {
+	out, err := merger.output()
+	if err != nil {
+		return err
+	}
+	files := []archiveFile{
+		{out.ManifestFD, merger.summaries()},
+	}
+	if out.Format() == FormatOCI {
+		files = append(files,
+			archiveFile{out.OCILayoutFD, v1.ImageLayout{Version: v1.ImageLayoutVersion}},
+			archiveFile{out.IndexFD, merger.index()})
+	} else {
+		files = append(files, archiveFile{out.RepositoriesFD, merger.repositories()})
+	}
+	for _, file := range files {
+		data, err := json.Marshal(file.value)
+		if err != nil {
+			return err
+		}
+		fw, err := file.open()
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(append(data, '\n'))
+		fw.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for d, content := range merger.blobs() {
+		fw, err := out.BlobFD(d)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(content)
+		fw.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobs returns the blobs written by the merger, the kept image indexes
+// and the attestations of the images.
+func (merger *ImageArchiveMerger) blobs() map[digest.Digest][]byte {
+	blobs := map[digest.Digest][]byte{}
+	for _, imageIndex := range merger.imageIndexes {
+		blobs[imageIndex.descriptor.Digest] = imageIndex.content
+	}
+	for _, entry := range merger.entries {
+		for d, content := range entry.AttestationFetcher.Blobs() {
+			blobs[d] = content
+		}
+	}
+	return blobs
+}
+
+// summaries lists an image once with all its tags, like docker save.
+// A tag is kept on the first image only, docker load would
+// otherwise move the tag to every image in turn.
+func (merger *ImageArchiveMerger) summaries() []manifestSummary {
+	summaries := []manifestSummary{}
+	configs := map[string]int{}
+	tagged := map[string]bool{}
+	digested := map[string]bool{}
+	for _, entry := range merger.entries {
+		summary := entry.ImageContentCollector.Summary()
+		i, ok := configs[summary.Config]
+		if !ok {
+			i = len(summaries)
+			configs[summary.Config] = i
+			summaries = append(summaries, manifestSummary{
+				Config:   summary.Config,
+				RepoTags: []string{},
+				Layers:   summary.Layers,
+			})
+		}
+		for _, repoTag := range summary.RepoTags {
+			if tagged[repoTag] {
+				continue
+			}
+			tagged[repoTag] = true
+			summaries[i].RepoTags = append(summaries[i].RepoTags, repoTag)
+		}
+		for _, repoDigest := range summary.RepoDigests {
+			if digested[repoDigest] {
+				continue
+			}
+			digested[repoDigest] = true
+			summaries[i].RepoDigests = append(summaries[i].RepoDigests, repoDigest)
+		}
+	}
+	return summaries
+}
+
+func (merger *ImageArchiveMerger) repositories() map[string]map[string]string {
+	repositories := map[string]map[string]string{}
+	for _, entry := range merger.entries {
+		for repo, tags := range entry.ImageContentCollector.Repositories() {
+			if repositories[repo] == nil {
+				repositories[repo] = map[string]string{}
+			}
+			for tag, v1ID := range tags {
+				if _, ok := repositories[repo][tag]; !ok {
+					repositories[repo][tag] = v1ID
+				}
+			}
+		}
+	}
+	return repositories
+}
+
+func (merger *ImageArchiveMerger) index() v1.Index {
+	index := v1.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+	for _, imageIndex := range merger.imageIndexes {
+		descriptor := imageIndex.descriptor
+		descriptor.Annotations = imageIndex.imageInfo.Annotations()
+		index.Manifests = append(index.Manifests, descriptor)
+	}
+	for _, entry := range merger.entries {
+		if _, ok := merger.keptImageIndex(entry); ok {
+			continue
+		}
+		index.Manifests = append(index.Manifests, entry.ImageContentCollector.ManifestDescriptor())
+		if attestation, ok := entry.AttestationFetcher.Descriptor(); ok {
+			index.Manifests = append(index.Manifests, attestation)
+		}
+	}
+	return index
+}
+
+func (merger *ImageArchiveMerger) ChtimesAll() error {
+	for _, entry := range merger.entries {
+		if err := Run01(entry.OutputFileManager, entry.OutputFileManager.ChtimesAll); err != nil {
+			return err
+		}
+	}
+	entry := merger.entries[0]
+	utc0Time := entry.ImageConfigBlobFetcher.UTC0Time()
+	for d := range merger.blobs() {
+		blobFileName := entry.OutputFileManager.BlobFileName(d)
+		if err := os.Chtimes(blobFileName, utc0Time, utc0Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanFloder removes every file of the staging folder which is not
+// part of one of the images.
+func (merger *ImageArchiveMerger) CleanFloder() error {
+	out, err := merger.output()
+	if err != nil {
+		return err
+	}
+	expected := map[string]bool{}
+	for _, entry := range merger.entries {
+		for name := range entry.OutputFileManager.ExpectedFiles() {
+			expected[name] = true
+		}
+	}
+	for d := range merger.blobs() {
+		blobFileName := out.BlobFileName(d)
+		rel, err := filepath.Rel(out.DownloadFloder(), blobFileName)
+		if err != nil {
+			return err
+		}
+		expected[rel] = true
+	}
+	return Run11(out, out.CleanFloder, expected)
+}
+
+func (merger *ImageArchiveMerger) TarImage() error {
+	out, err := merger.output()
+	if err != nil {
+		return err
+	}
+	return Run01(out, out.TarImage)
+}
@@ -21,6 +21,7 @@ type ImageConfigBlobFetcher struct {
 	imageInfo        *ImageInfoManager
 	imageConfig      *ImageConfigFetcher
 	outputFileInfo   *OutputFileManager
+	blobCache        *BlobCache
 	httpClientCreate HttpClientFn
 	initialized      bool
 }
@@ -44,6 +45,9 @@ func (blob *ImageConfigBlobFetcher) Initialize(entry *EntryPoint) {
 	if entry.OutputFileManager == nil {
 		panic("ImageConfigBlobFetcher init failed, EntryPoint's outputFileInfo is nil")
 	}
+	if entry.BlobCache == nil {
+		panic("ImageConfigBlobFetcher init failed, EntryPoint's BlobCache is nil")
+	}
 	if entry.HttpClientFnPtr == nil {
 		panic("ImageConfigBlobFetcher init failed, EntryPoint's httpClientFnPtr is nil")
 	}
@@ -52,6 +56,7 @@ func (blob *ImageConfigBlobFetcher) Initialize(entry *EntryPoint) {
 	blob.imageConfig = entry.ImageConfigFetcher
 	blob.requestInfo = entry.RequestInfoManager
 	blob.outputFileInfo = entry.OutputFileManager
+	blob.blobCache = entry.BlobCache
 	blob.httpClientCreate = *entry.HttpClientFnPtr
 	blob.initialized = true
 }
@@ -64,49 +69,85 @@ func (blob *ImageConfigBlobFetcher) InitializeCheck() {
 }
 
 func (blob *ImageConfigBlobFetcher) Run() error {
-	client := blob.httpClientCreate()
-	requestInfo := blob.requestInfo
-	imageConfig := blob.imageConfig
-	configDigest := imageConfig.ConfigDigest()
-	blobURL := fmt.Sprintf("%s/v2/%s/%s/blobs/%s",
-		requestInfo.RegistryEndpoint(),
-		requestInfo.Repository(),
-		requestInfo.ImageName(),
-		configDigest)
-	req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+	body, err := blob.configBlob()
 	if err != nil {
 		return err
 	}
-	req.Header.Set(HeaderAccept, v1.MediaTypeImageConfig)
-	authenticator := blob.authenticator
-	authenticator.Authorize(req)
-	resp, err := client.Do(req)
+	err = json.Unmarshal(body, &blob.blobImage)
 	if err != nil {
 		return err
 	}
+	blob.blobContent = make([]byte, len(body))
+	copy(blob.blobContent, body)
+	return nil
+}
+
+func (blob *ImageConfigBlobFetcher) configBlob() ([]byte, error) {
+	if schema1 := blob.imageConfig.Schema1(); schema1 != nil {
+		return blob.convertSchema1(schema1)
+	}
+	configDigest := blob.imageConfig.ConfigDigest()
+	if err := configDigest.Validate(); err != nil {
+		return nil, err
+	}
+	body, ok := blob.blobCache.ReadAll(configDigest)
+	if ok {
+		return body, nil
+	}
+	body, err := blob.fetch(configDigest)
+	if err != nil {
+		return nil, err
+	}
+	if blob.blobCache.Enabled() {
+		blob.blobCache.Store(configDigest, body)
+	}
+	return body, nil
+}
+
+func (blob *ImageConfigBlobFetcher) fetch(configDigest digest.Digest) ([]byte, error) {
+	return fetchConfigBlob(blob.httpClientCreate(), blob.requestInfo, blob.authenticator, configDigest)
+}
+
+// fetchConfigBlob reads the image config in memory and verifies it
+func fetchConfigBlob(client *http.Client, requestInfo *RequestInfoManager, authenticator *Authenticator, configDigest digest.Digest) ([]byte, error) {
+	return fetchBlob(client, requestInfo, authenticator, configDigest, v1.MediaTypeImageConfig)
+}
+
+// fetchBlob reads a small blob in memory and verifies it
+func fetchBlob(client *http.Client, requestInfo *RequestInfoManager, authenticator *Authenticator, blobDigest digest.Digest, mediaType string) ([]byte, error) {
+	blobURL := fmt.Sprintf("%s/blobs/%s",
+		requestInfo.RepositoryURL(),
+		blobDigest)
+	req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HeaderAccept, mediaType)
+	resp, err := authenticator.Do(client, req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("get image config blobs failed, %s", resp.Status)
+		return nil, fmt.Errorf("get blob %s failed, %s", blobDigest, resp.Status)
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = json.Unmarshal(body, &blob.blobImage)
-	if err != nil {
-		return err
+	if actual := blobDigest.Algorithm().FromBytes(body); actual != blobDigest {
+		return nil, fmt.Errorf("blob %s: digest mismatch, got %s", blobDigest, actual)
 	}
-	blob.blobContent = make([]byte, len(body))
-	copy(blob.blobContent, body)
-	return nil
+	return body, nil
 }
 
 func (blob *ImageConfigBlobFetcher) Content() []byte {
 	return blob.blobContent[:]
 }
 
+// DiffIDs returns a copy, identity.ChainIDs rewrites the slice in place.
 func (blob *ImageConfigBlobFetcher) DiffIDs() []digest.Digest {
-	return blob.blobImage.RootFS.DiffIDs[:]
+	return append([]digest.Digest{}, blob.blobImage.RootFS.DiffIDs...)
 }
 
 func (blob *ImageConfigBlobFetcher) WriteTo(dst io.Writer) (int64, error) {
@@ -144,8 +185,17 @@ func (blob *ImageConfigBlobFetcher) OS() string {
 	return blob.blobImage.OS
 }
 
+func (blob *ImageConfigBlobFetcher) Platform() *v1.Platform {
+	return &v1.Platform{
+		Architecture: blob.blobImage.Architecture,
+		OS:           blob.blobImage.OS,
+		OSVersion:    blob.blobImage.OSVersion,
+		Variant:      blob.blobImage.Variant,
+	}
+}
+
 func (blob *ImageConfigBlobFetcher) ConfigDigest() string {
 	imageConfig := blob.imageConfig
-	configDigest := imageConfig.ConfigDigest()
-	return configDigest.Encoded()
+	blobDigest := imageConfig.ConfigDigest()
+	return blobDigest.Encoded()
 }
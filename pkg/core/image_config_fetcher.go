@@ -6,15 +6,23 @@ import (
 	"io"
 	"net/http"
 
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type ImageConfigFetcher struct {
+	schema1            *schema1Manifest
+	manifestContent    []byte
+	manifestDigest     digest.Digest
+	manifestMediaType  string
 	configDigest       digest.Digest
+	configSize         int64
+	configMediaType    string
 	blobDigestWithType map[digest.Digest]string
 	blobDigestWithSize map[digest.Digest]int64
 	blobDigests        []digest.Digest
+	rateLimitWait      bool
 
 	authenticator    *Authenticator
 	requestInfo      *RequestInfoManager
@@ -53,32 +61,39 @@ func (config *ImageConfigFetcher) InitializeCheck() {
 	panic("ImageConfigFetcher not init")
 }
 
+func (config *ImageConfigFetcher) ApplyConfig(cliConfig *cli.Config) error {
+	if cliConfig == nil {
+		return fmt.Errorf("imageConfigFetcher: ApplyConfig Failed, Config object is nil")
+	}
+	config.rateLimitWait = cliConfig.RateLimitWait()
+	return nil
+}
+
 func (config *ImageConfigFetcher) Run() error {
 	client := config.httpClientCreate()
 	requestInfo := config.requestInfo
-	arch := requestInfo.Architecture()
 	imageIndex := config.imageIndex
-	archDigest, ok := imageIndex.SelectDigestByArchitecture(arch)
-	if !ok {
-		return fmt.Errorf("no atchitecture found")
-	}
-	manifestURL := fmt.Sprintf("%s/v2/%s/%s/manifests/%s",
-		requestInfo.RegistryEndpoint(),
-		requestInfo.Repository(),
-		requestInfo.ImageName(),
+	archDigest, err := imageIndex.SelectDigestByPlatform(requestInfo.Platform())
+	if err != nil {
+		return err
+	}
+	manifestURL := fmt.Sprintf("%s/manifests/%s",
+		requestInfo.RepositoryURL(),
 		archDigest)
 	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Set(HeaderAccept, v1.MediaTypeImageManifest)
+	req.Header.Set(HeaderAccept, imageManifestAcceptTypes)
 	authenticator := config.authenticator
-	authenticator.Authorize(req)
-	resp, err := client.Do(req)
+	resp, err := doManifestRequest(client, authenticator, req, config.rateLimitWait)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("get image config failed, %v", rateLimitError(resp))
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("get image config failed, %s", resp.Status)
 	}
@@ -86,12 +101,34 @@ func (config *ImageConfigFetcher) Run() error {
 	if err != nil {
 		return err
 	}
+	mediaType := responseMediaType(resp.Header.Get(HeaderContentType), body)
+	digestContent, err := manifestDigestContent(mediaType, body)
+	if err != nil {
+		return err
+	}
+	if manifestDigest, err := digest.Parse(archDigest); err == nil {
+		if err := verifyManifest(manifestDigest, digestContent); err != nil {
+			return err
+		}
+	}
+	switch {
+	case isManifestMediaType(mediaType):
+	case isSchema1MediaType(mediaType):
+		return config.collectSchema1(body, digestContent, mediaType)
+	default:
+		return fmt.Errorf("%s is not an image manifest", mediaType)
+	}
 	var manifest v1.Manifest
 	err = json.Unmarshal(body, &manifest)
 	if err != nil {
 		return err
 	}
+	config.manifestContent = body
+	config.manifestDigest = digest.FromBytes(body)
+	config.manifestMediaType = mediaType
 	config.configDigest = manifest.Config.Digest
+	config.configSize = manifest.Config.Size
+	config.configMediaType = manifest.Config.MediaType
 	config.blobDigestWithType = map[digest.Digest]string{}
 	config.blobDigestWithSize = map[digest.Digest]int64{}
 	config.blobDigests = make([]digest.Digest, len(manifest.Layers))
@@ -103,6 +140,66 @@ func (config *ImageConfigFetcher) Run() error {
 	return nil
 }
 
+// collectSchema1 keeps the layers of a schema1 manifest, the image config
+// is rebuilt by ImageConfigBlobFetcher once the diff IDs are known.
+func (config *ImageConfigFetcher) collectSchema1(body []byte, digestContent []byte, mediaType string) error {
+	manifest, err := parseSchema1Manifest(body)
+	if err != nil {
+		return err
+	}
+	blobDigests, err := manifest.BlobDigests()
+	if err != nil {
+		return err
+	}
+	config.schema1 = manifest
+	config.manifestContent = body
+	config.manifestDigest = digest.FromBytes(digestContent)
+	config.manifestMediaType = mediaType
+	config.blobDigestWithType = map[digest.Digest]string{}
+	config.blobDigestWithSize = map[digest.Digest]int64{}
+	config.blobDigests = blobDigests
+	for _, blobDigest := range blobDigests {
+		config.blobDigestWithType[blobDigest] = MediaTypeDockerLayer
+	}
+	return nil
+}
+
+// Schema1 returns the legacy manifest, nil for the other manifests
+func (config *ImageConfigFetcher) Schema1() *schema1Manifest {
+	return config.schema1
+}
+
+func (config *ImageConfigFetcher) setConfigDescriptor(descriptor v1.Descriptor) {
+	config.configDigest = descriptor.Digest
+	config.configSize = descriptor.Size
+	config.configMediaType = descriptor.MediaType
+}
+
+func (config *ImageConfigFetcher) setBlobSize(d digest.Digest, size int64) {
+	config.blobDigestWithSize[d] = size
+}
+
+// Manifest returns the manifest exactly as served by the registry
+func (config *ImageConfigFetcher) Manifest() []byte {
+	return config.manifestContent
+}
+
+func (config *ImageConfigFetcher) ManifestDescriptor() v1.Descriptor {
+	return v1.Descriptor{
+		MediaType: config.manifestMediaType,
+		Digest:    config.manifestDigest,
+		Size:      int64(len(config.manifestContent)),
+	}
+}
+
+func (config *ImageConfigFetcher) ConfigDescriptor() v1.Descriptor {
+	return v1.Descriptor{
+		MediaType: config.configMediaType,
+		Digest:    config.configDigest,
+		Size:      config.configSize,
+	}
+}
+
 func (config *ImageConfigFetcher) ConfigDigest() digest.Digest {
 	return config.configDigest
 }
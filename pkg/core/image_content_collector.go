@@ -11,17 +11,28 @@ import (
 	moby "github.com/excitedplus1s/spec-go/moby"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/identity"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// manifestSummary is an entry of the manifest.json read by docker load
+type manifestSummary struct {
+	Config      string   `json:"Config"`
+	RepoTags    []string `json:"RepoTags"`
+	RepoDigests []string `json:"RepoDigests,omitempty"`
+	Layers      []string `json:"Layers"`
+}
+
 type ImageContentCollector struct {
-	manifestJson       []byte
-	repositoriesJson   []byte
+	summary            manifestSummary
+	repositories       map[string]map[string]string
+	manifestDescriptor v1.Descriptor
 	blobSumV1          map[string][]string
 	emptyLayerBlobSums []string
 	v1Jsons            map[string][]byte
 	v1IDs              []string
 
 	imageInfo       *ImageInfoManager
+	imageIndex      *ImageIndexFetcher
 	imageConfig     *ImageConfigFetcher
 	imageConfigBlob *ImageConfigBlobFetcher
 	outputFileInfo  *OutputFileManager
@@ -35,6 +46,9 @@ func (gen *ImageContentCollector) Initialize(entry *EntryPoint) {
 	if entry.ImageInfoManager == nil {
 		panic("ImageContentCollector init failed, EntryPoint's ImageInfoManager is nil")
 	}
+	if entry.ImageIndexFetcher == nil {
+		panic("ImageContentCollector init failed, EntryPoint's ImageIndexFetcher is nil")
+	}
 	if entry.ImageConfigFetcher == nil {
 		panic("ImageContentCollector init failed, EntryPoint's ImageConfigFetcher is nil")
 	}
@@ -45,6 +59,7 @@ func (gen *ImageContentCollector) Initialize(entry *EntryPoint) {
 		panic("ImageContentCollector init failed, EntryPoint's outputFileInfo is nil")
 	}
 	gen.imageInfo = entry.ImageInfoManager
+	gen.imageIndex = entry.ImageIndexFetcher
 	gen.imageConfig = entry.ImageConfigFetcher
 	gen.imageConfigBlob = entry.ImageConfigBlobFetcher
 	gen.outputFileInfo = entry.OutputFileManager
@@ -61,6 +76,9 @@ func (gen *ImageContentCollector) InitializeCheck() {
 }
 
 func (gen *ImageContentCollector) Run() error {
+	if gen.outputFileInfo.Format() == FormatOCI {
+		return gen.collectOCILayout()
+	}
 	imageConfigBlob := gen.imageConfigBlob
 	layerIDs := identity.ChainIDs(imageConfigBlob.DiffIDs())
 	var parent digest.Digest
@@ -102,67 +120,80 @@ func (gen *ImageContentCollector) Run() error {
 		}
 		gen.blobSumV1[blobDigests[index].Encoded()] = append(blobList, v1ID.Encoded())
 	}
-	type Summary struct {
-		Config   string   `json:"Config"`
-		RepoTags []string `json:"RepoTags"`
-		Layers   []string `json:"Layers"`
-	}
 	imageInfo := gen.imageInfo
-	repoTag := imageInfo.FullName()
-
-	repoTags := append([]string{}, repoTag)
 	layers := []string{}
 
 	for _, v1ID := range v1IDs {
 		layers = append(layers, v1ID.Encoded()+"/layer.tar")
 	}
 
-	summary := Summary{
-		Config:   imageConfig.ConfigDigest().Encoded() + ".json",
-		RepoTags: repoTags,
-		Layers:   layers,
+	gen.summary = manifestSummary{
+		Config:      imageConfig.ConfigDigest().Encoded() + ".json",
+		RepoTags:    gen.repoTags(),
+		RepoDigests: gen.repoDigests(),
+		Layers:      layers,
 	}
+	gen.repositories = map[string]map[string]string{}
+	if len(imageInfo.Tag()) > 0 {
+		versionMap := map[string]string{
+			imageInfo.Tag(): v1IDs[len(v1IDs)-1].Encoded(),
+		}
+		gen.repositories[imageInfo.FullNameWithoutTag()] = versionMap
+	}
+	return nil
+}
 
-	summarys := []Summary{}
-	summarys = append(summarys, summary)
-
-	manifestJson, err := json.Marshal(summarys)
-	if err != nil {
-		return err
+// repoTags is empty for an image pinned by digest only
+func (gen *ImageContentCollector) repoTags() []string {
+	if len(gen.imageInfo.Tag()) == 0 {
+		return []string{}
 	}
-	gen.manifestJson = append(manifestJson, '\n')
+	return []string{gen.imageInfo.FullName()}
+}
 
-	versionMap := map[string]string{
-		imageInfo.Tag(): v1IDs[len(v1IDs)-1].Encoded(),
+func (gen *ImageContentCollector) repoDigests() []string {
+	referenceDigest := gen.imageIndex.ReferenceDigest()
+	if len(referenceDigest) == 0 {
+		return nil
 	}
-	repositories := map[string]map[string]string{
-		imageInfo.FullNameWithoutTag(): versionMap,
+	return []string{gen.imageInfo.FullNameWithoutTag() + "@" + referenceDigest.String()}
+}
+
+// collectOCILayout keeps the manifest and the layers as pulled, only the
+// index pointing to the manifest is generated.
+func (gen *ImageContentCollector) collectOCILayout() error {
+	imageInfo := gen.imageInfo
+	imageConfig := gen.imageConfig
+	gen.manifestDescriptor = imageConfig.ManifestDescriptor()
+	gen.manifestDescriptor.Platform = gen.imageConfigBlob.Platform()
+	gen.manifestDescriptor.Annotations = imageInfo.Annotations()
+	layers := []string{}
+	for _, blobDigest := range imageConfig.BlobDigests() {
+		layers = append(layers, ociBlobPath(blobDigest))
 	}
-	repositoriesJson, err := json.Marshal(repositories)
-	if err != nil {
-		return err
+	gen.summary = manifestSummary{
+		Config:      ociBlobPath(imageConfig.ConfigDigest()),
+		RepoTags:    gen.repoTags(),
+		RepoDigests: gen.repoDigests(),
+		Layers:      layers,
 	}
-	gen.repositoriesJson = append(repositoriesJson, '\n')
 	return nil
 }
 
+func ociBlobPath(d digest.Digest) string {
+	return fmt.Sprintf("blobs/%s/%s", d.Algorithm(), d.Encoded())
+}
+
+// WriteToFile writes the files of this image only, the files shared by
+// every image of the archive are written by ImageArchiveMerger.
 func (gen *ImageContentCollector) WriteToFile() error {
-	fmanifest, err := gen.outputFileInfo.ManifestFD()
-	if err != nil {
-		return err
-	}
-	defer fmanifest.Close()
-	_, err = fmanifest.Write(gen.manifestJson)
-	if err != nil {
-		return err
-	}
-	frepositories, err := gen.outputFileInfo.RepositoriesFD()
-	if err != nil {
-		return err
-	}
-	defer frepositories.Close()
-	_, err = frepositories.Write(gen.repositoriesJson)
-	if err != nil {
+	if gen.outputFileInfo.Format() == FormatOCI {
+		fmanifest, err := gen.outputFileInfo.ManifestBlobFD()
+		if err != nil {
+			return err
+		}
+		defer fmanifest.Close()
+		_, err = fmanifest.Write(gen.imageConfig.Manifest())
 		return err
 	}
 	for v1ID, data := range gen.v1Jsons {
@@ -202,6 +233,10 @@ func (gen *ImageContentCollector) WriteToFile() error {
 			if err != nil {
 				return err
 			}
+			// The link may already exist when a pull is resumed
+			if err := os.Remove(dstFile); err != nil && !os.IsNotExist(err) {
+				return err
+			}
 			err = os.Symlink(srcFile, dstFile)
 			if err != nil {
 				return err
@@ -220,3 +255,18 @@ func (gen *ImageContentCollector) GetV1IDsByBlobSum(blobSum string) ([]string, b
 func (gen *ImageContentCollector) V1IDs() []string {
 	return gen.v1IDs
 }
+
+// Summary returns the entry of this image in manifest.json
+func (gen *ImageContentCollector) Summary() manifestSummary {
+	return gen.summary
+}
+
+// Repositories returns the content of the legacy repositories file
+func (gen *ImageContentCollector) Repositories() map[string]map[string]string {
+	return gen.repositories
+}
+
+// ManifestDescriptor returns the entry of this image in index.json
+func (gen *ImageContentCollector) ManifestDescriptor() v1.Descriptor {
+	return gen.manifestDescriptor
+}
@@ -5,13 +5,23 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type ImageIndexFetcher struct {
-	architectureIndex map[string]digest.Digest
+	// The platforms in the order of the image index
+	platforms []indexPlatform
+	// The attestation manifests by the digest of the image manifest
+	attestations    map[digest.Digest]v1.Descriptor
+	indexContent    []byte
+	indexManifests  []digest.Digest
+	indexMediaType  string
+	referenceDigest digest.Digest
+	rateLimitWait   bool
 
 	authenticator    *Authenticator
 	requestInfo      *RequestInfoManager
@@ -32,9 +42,6 @@ func (index *ImageIndexFetcher) Initialize(entry *EntryPoint) {
 	if entry.HttpClientFnPtr == nil {
 		panic("ImageIndexFetcher init failed, EntryPoint's httpClientFnPtr is nil")
 	}
-	if index.architectureIndex == nil {
-		index.architectureIndex = map[string]digest.Digest{}
-	}
 	index.authenticator = entry.Authenticator
 	index.requestInfo = entry.RequestInfoManager
 	index.httpClientCreate = *entry.HttpClientFnPtr
@@ -48,98 +55,264 @@ func (index *ImageIndexFetcher) InitializeCheck() {
 	panic("ImageIndexFetcher not init")
 }
 
-func (index *ImageIndexFetcher) isSupportedIndexType(mt string) bool {
-	const MediaTypeDockerSchema2ManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
-	switch mt {
-	case v1.MediaTypeImageIndex, MediaTypeDockerSchema2ManifestList:
-		return true
-	default:
-		return false
+func (index *ImageIndexFetcher) ApplyConfig(config *cli.Config) error {
+	if config == nil {
+		return fmt.Errorf("imageIndexFetcher: ApplyConfig Failed, Config object is nil")
 	}
+	index.rateLimitWait = config.RateLimitWait()
+	return nil
 }
 
 func (index *ImageIndexFetcher) Run() error {
 	client := index.httpClientCreate()
 	requestInfo := index.requestInfo
-	indexURL := fmt.Sprintf("%s/v2/%s/%s/manifests/%s",
-		requestInfo.RegistryEndpoint(),
-		requestInfo.Repository(),
-		requestInfo.ImageName(),
-		requestInfo.Tag())
+	indexURL := fmt.Sprintf("%s/manifests/%s",
+		requestInfo.RepositoryURL(),
+		requestInfo.Reference())
 	req, err := http.NewRequest(http.MethodGet, indexURL, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Set(HeaderAccept, v1.MediaTypeImageIndex)
+	req.Header.Set(HeaderAccept, manifestAcceptTypes)
 	authenticator := index.authenticator
-	authenticator.Authorize(req)
-	resp, err := client.Do(req)
+	resp, err := doManifestRequest(client, authenticator, req, index.rateLimitWait)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("get index info failed, %v", rateLimitError(resp))
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("get index info failed, %s", resp.Status)
 	}
+	warnRateLimit(resp.Header)
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
-	var v1index v1.Index
-	err = json.Unmarshal(body, &v1index)
+	mediaType := responseMediaType(resp.Header.Get(HeaderContentType), body)
+	digestContent, err := manifestDigestContent(mediaType, body)
 	if err != nil {
 		return err
 	}
-	for _, manifest := range v1index.Manifests {
-		if manifest.Platform.OS == "linux" {
-			arch := manifest.Platform.Architecture
-			variant := manifest.Platform.Variant
-			digest := manifest.Digest
-			index.architectureIndex[arch+variant] = digest
+	index.referenceDigest = digest.FromBytes(digestContent)
+	if pinned := requestInfo.Digest(); len(pinned) > 0 {
+		if err := verifyManifest(pinned, digestContent); err != nil {
+			return err
 		}
+		index.referenceDigest = pinned
 	}
-	if len(index.architectureIndex) == 0 {
-		//index fetch can be skip,we should check it
-		var manifest v1.Manifest
-		err = json.Unmarshal(body, &manifest)
+	switch {
+	case isIndexMediaType(mediaType):
+		return index.collectIndex(body, mediaType)
+	case isManifestMediaType(mediaType):
+		return index.collectManifest(client, body)
+	case isSchema1MediaType(mediaType):
+		manifest, err := parseSchema1Manifest(body)
 		if err != nil {
 			return err
 		}
+		index.addPlatform(v1.Platform{
+			OS:           defaultPlatformOS,
+			Architecture: manifest.Architecture,
+		}, digest.Digest(""))
+		return nil
+	default:
+		return fmt.Errorf("%s is not support now,please let me know", mediaType)
+	}
+}
 
-		if manifest.Annotations != nil {
-			const dockerArch = "com.docker.official-images.bashbrew.arch"
-			arch, ok := manifest.Annotations[dockerArch]
-			if ok {
-				index.architectureIndex[arch] = digest.Digest("")
-				return nil
-			}
+func (index *ImageIndexFetcher) collectIndex(body []byte, mediaType string) error {
+	var v1index v1.Index
+	if err := json.Unmarshal(body, &v1index); err != nil {
+		return err
+	}
+	for _, manifest := range v1index.Manifests {
+		index.indexManifests = append(index.indexManifests, manifest.Digest)
+		if manifest.Annotations[AnnotationReferenceType] == ReferenceTypeAttestation {
+			index.addAttestation(manifest)
+			continue
 		}
-		respContentType := resp.Header.Get(HeaderContentType)
-		if !index.isSupportedIndexType(v1index.MediaType) {
-			return fmt.Errorf("%s is not support now,please let me know", string(respContentType))
+		if manifest.Platform == nil {
+			continue
 		}
+		if manifest.Platform.OS == "unknown" || manifest.Platform.Architecture == "unknown" {
+			continue
+		}
+		index.addPlatform(*manifest.Platform, manifest.Digest)
+	}
+	if len(index.platforms) == 0 {
 		return fmt.Errorf("no platform found in %s", string(body))
 	}
+	index.indexContent = body
+	index.indexMediaType = mediaType
+	return nil
+}
+
+// collectManifest handles a tag pointing to a single manifest,
+// the platform is read from the image config.
+func (index *ImageIndexFetcher) collectManifest(client *http.Client, body []byte) error {
+	var manifest v1.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return err
+	}
+	if err := manifest.Config.Digest.Validate(); err != nil {
+		return fmt.Errorf("image config digest: %v", err)
+	}
+	configBlob, err := fetchConfigBlob(client, index.requestInfo, index.authenticator, manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	var platform v1.Platform
+	if err := json.Unmarshal(configBlob, &platform); err != nil {
+		return err
+	}
+	if len(platform.Architecture) == 0 {
+		return fmt.Errorf("no platform found in %s", string(configBlob))
+	}
+	index.addPlatform(platform, digest.Digest(""))
 	return nil
 }
 
-func (index *ImageIndexFetcher) AvailableArch() []string {
-	result := make([]string, len(index.architectureIndex))
-	i := 0
-	for key, _ := range index.architectureIndex {
-		result[i] = key
-		i++
+func (index *ImageIndexFetcher) addPlatform(platform v1.Platform, manifestDigest digest.Digest) {
+	index.platforms = append(index.platforms, indexPlatform{
+		platform: platform,
+		digest:   manifestDigest,
+	})
+}
+
+func (index *ImageIndexFetcher) addAttestation(manifest v1.Descriptor) {
+	reference, err := digest.Parse(manifest.Annotations[AnnotationReferenceDigest])
+	if err != nil {
+		return
+	}
+	if index.attestations == nil {
+		index.attestations = map[digest.Digest]v1.Descriptor{}
+	}
+	index.attestations[reference] = manifest
+}
+
+// Attestation returns the attestation manifest of an image manifest of the index
+func (index *ImageIndexFetcher) Attestation(manifestDigest digest.Digest) (v1.Descriptor, bool) {
+	attestation, ok := index.attestations[manifestDigest]
+	return attestation, ok
+}
+
+// ReferenceDigest is the digest of the index or the manifest the
+// tag points to, docker keeps it in the RepoDigests of the image.
+func (index *ImageIndexFetcher) ReferenceDigest() digest.Digest {
+	return index.referenceDigest
+}
+
+// AvailablePlatforms returns the platforms in the order of the image index
+func (index *ImageIndexFetcher) AvailablePlatforms() []string {
+	var result []string
+	for _, p := range index.platforms {
+		result = append(result, formatPlatform(p.platform))
 	}
 	return result
 }
 
-func (index *ImageIndexFetcher) SelectDigestByArchitecture(arch string) (string, bool) {
-	dig, ok := index.architectureIndex[arch]
-	if ok {
-		if dig == "" {
-			requestInfo := index.requestInfo
-			return requestInfo.Tag(), ok
+// findPlatform returns the first manifest of the index matching the selector.
+// The -arch keys like arm64v8 are tried before the os/arch[/variant] form.
+func (index *ImageIndexFetcher) findPlatform(selector string) (indexPlatform, error) {
+	for _, p := range index.platforms {
+		if legacyArchitecture(p.platform) == selector {
+			return p, nil
+		}
+	}
+	want, err := parsePlatform(selector)
+	if err != nil {
+		return indexPlatform{}, err
+	}
+	for _, p := range index.platforms {
+		if matchPlatform(want, p.platform) {
+			return p, nil
+		}
+	}
+	return indexPlatform{}, fmt.Errorf("platform %s not found, available: %s",
+		selector, strings.Join(index.AvailablePlatforms(), ", "))
+}
+
+// SelectPlatforms checks the requested platforms against the index and
+// returns the platforms of the matched manifests,
+// "all" selects every platform of the index.
+func (index *ImageIndexFetcher) SelectPlatforms(requested []string) ([]string, error) {
+	if len(requested) == 1 && requested[0] == AllArchitectures {
+		return index.AvailablePlatforms(), nil
+	}
+	var result []string
+	selected := map[string]bool{}
+	for _, selector := range requested {
+		p, err := index.findPlatform(selector)
+		if err != nil {
+			return nil, err
+		}
+		platform := formatPlatform(p.platform)
+		if selected[platform] {
+			continue
+		}
+		selected[platform] = true
+		result = append(result, platform)
+	}
+	return result, nil
+}
+
+// ImageIndexCoveredBy tells if every manifest of the image index
+// is pulled with the given platforms, and their attestations if asked.
+func (index *ImageIndexFetcher) ImageIndexCoveredBy(platforms []string, attestations bool) bool {
+	pulled := map[digest.Digest]bool{}
+	for _, selector := range platforms {
+		p, err := index.findPlatform(selector)
+		if err != nil {
+			return false
+		}
+		pulled[p.digest] = true
+		if attestation, ok := index.attestations[p.digest]; ok && attestations {
+			pulled[attestation.Digest] = true
+		}
+	}
+	for _, manifest := range index.indexManifests {
+		if !pulled[manifest] {
+			return false
 		}
 	}
-	return dig.String(), ok
+	return true
+}
+
+// ImageIndex returns the image index as pulled, false if the registry
+// returned a single manifest.
+func (index *ImageIndexFetcher) ImageIndex() ([]byte, v1.Descriptor, bool) {
+	if len(index.indexContent) == 0 {
+		return nil, v1.Descriptor{}, false
+	}
+	return index.indexContent, v1.Descriptor{
+		MediaType: index.indexMediaType,
+		Digest:    digest.FromBytes(index.indexContent),
+		Size:      int64(len(index.indexContent)),
+	}, true
+}
+
+func (index *ImageIndexFetcher) SelectDigestByPlatform(selector string) (string, error) {
+	p, err := index.findPlatform(selector)
+	if err != nil {
+		return "", err
+	}
+	if p.digest == "" {
+		requestInfo := index.requestInfo
+		return requestInfo.Reference(), nil
+	}
+	return p.digest.String(), nil
+}
+
+// verifyManifest checks a manifest or an index pulled by digest
+func verifyManifest(d digest.Digest, content []byte) error {
+	if !d.Algorithm().Available() {
+		return fmt.Errorf("digest %s: algorithm not available", d)
+	}
+	if d.Algorithm().FromBytes(content) != d {
+		return fmt.Errorf("manifest %s: content does not match digest", d)
+	}
+	return nil
 }
@@ -5,16 +5,21 @@ import (
 	"strings"
 
 	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 var defaultRegistry = "registry-1.docker.io"
 
 type ImageInfoManager struct {
 	registry     string
+	path         string
 	repository   string
 	imageName    string
 	tag          string
+	digest       digest.Digest
 	architecture string
+	platform     string
 	username     string
 	password     string
 }
@@ -36,37 +41,28 @@ func (info *ImageInfoManager) ApplyConfig(config *cli.Config) error {
 	info.username = config.UserName()
 	info.password = config.Password()
 	info.architecture = config.Architecture()
-	imageInfo := config.ImageInfo()
-	parts := strings.Count(imageInfo, "/")
-	cutImageTag := func(data string) (string, string) {
-		image, tag, ok := strings.Cut(data, ":")
-		if !ok {
-			tag = "latest"
-		}
-		return image, tag
+	info.platform = config.Platform()
+	if len(info.platform) == 0 {
+		info.platform = info.architecture
 	}
-	if parts < 2 {
+	ref, err := parseReference(config.ImageInfo())
+	if err != nil {
+		return err
+	}
+	info.registry = ref.domain
+	if ref.domain == dockerHubDomain {
 		info.registry = defaultRegistry
-		if parts == 0 {
-			info.repository = "library"
-			imageName, tag := cutImageTag(imageInfo)
-			info.imageName = imageName
-			info.tag = tag
-		} else {
-			repository, imageWithTag, _ := strings.Cut(imageInfo, "/")
-			info.repository = repository
-			imageName, tag := cutImageTag(imageWithTag)
-			info.imageName = imageName
-			info.tag = tag
-		}
-	} else {
-		registry, suffix, _ := strings.Cut(imageInfo, "/")
-		info.registry = registry
-		repository, imageWithTag, _ := strings.Cut(suffix, "/")
-		info.repository = repository
-		imageName, tag := cutImageTag(imageWithTag)
-		info.imageName = imageName
-		info.tag = tag
+	}
+	info.path = ref.path
+	info.repository, info.imageName = "", ref.path
+	if i := strings.LastIndex(ref.path, "/"); i >= 0 {
+		info.repository, info.imageName = ref.path[:i], ref.path[i+1:]
+	}
+	info.tag = ref.tag
+	info.digest = ref.digest
+	// The tag is optional when the image is pinned by digest
+	if len(info.tag) == 0 && len(info.digest) == 0 {
+		info.tag = "latest"
 	}
 	return nil
 }
@@ -82,6 +78,11 @@ func (info *ImageInfoManager) Registry() string {
 	return info.registry
 }
 
+// Path is the full repository path, library/nginx for nginx
+func (info *ImageInfoManager) Path() string {
+	return info.path
+}
+
 func (info *ImageInfoManager) Repository() string {
 	return info.repository
 }
@@ -94,28 +95,73 @@ func (info *ImageInfoManager) Tag() string {
 	return info.tag
 }
 
+func (info *ImageInfoManager) Digest() digest.Digest {
+	return info.digest
+}
+
+// Reference is the digest of a pinned image, the tag otherwise
+func (info *ImageInfoManager) Reference() string {
+	if len(info.digest) > 0 {
+		return info.digest.String()
+	}
+	return info.tag
+}
+
 func (info *ImageInfoManager) Architecture() string {
 	return info.architecture
 }
 
+// Platform is the platform selector of the image, the architecture
+// is used when no platform is set.
+func (info *ImageInfoManager) Platform() string {
+	return info.platform
+}
+
 func (info *ImageInfoManager) FullNameWithoutTag() string {
 	if info.Registry() == defaultRegistry {
-		if info.Repository() == "library" {
-			return info.ImageName()
-		} else {
-			return fmt.Sprintf("%s/%s",
-				info.Repository(),
-				info.ImageName())
-		}
+		return strings.TrimPrefix(info.Path(), officialRepository+"/")
 	}
-	return fmt.Sprintf("%s/%s/%s",
+	return fmt.Sprintf("%s/%s",
 		info.Registry(),
-		info.Repository(),
-		info.ImageName())
+		info.Path())
 }
 
 func (info *ImageInfoManager) FullName() string {
+	if len(info.Tag()) == 0 {
+		return fmt.Sprintf("%s@%s",
+			info.FullNameWithoutTag(),
+			info.Digest())
+	}
 	return fmt.Sprintf("%s:%s",
 		info.FullNameWithoutTag(),
 		info.Tag())
 }
+
+// CanonicalName is the fully qualified reference used by containerd
+func (info *ImageInfoManager) CanonicalName() string {
+	registry := info.Registry()
+	if registry == defaultRegistry {
+		registry = dockerHubDomain
+	}
+	name := fmt.Sprintf("%s/%s",
+		registry,
+		info.Path())
+	if len(info.Tag()) > 0 {
+		name += ":" + info.Tag()
+	}
+	if len(info.Digest()) > 0 {
+		name += "@" + info.Digest().String()
+	}
+	return name
+}
+
+// Annotations name the image in the index.json of the OCI image layout
+func (info *ImageInfoManager) Annotations() map[string]string {
+	annotations := map[string]string{
+		AnnotationImageName: info.CanonicalName(),
+	}
+	if len(info.Tag()) > 0 {
+		annotations[v1.AnnotationRefName] = info.Tag()
+	}
+	return annotations
+}
@@ -2,21 +2,39 @@ package core
 
 import (
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
 	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
 	"github.com/schollz/progressbar/v3"
 )
 
+// Compressed layers smaller than this are streamed without a download file,
+// fetching them again is cheaper than writing them twice.
+const resumableLayerSize = 64 << 20
+
 type LayerDownloader struct {
+	parallel  int
+	retries   int
+	retryWait time.Duration
+	diffIDs   map[digest.Digest]digest.Digest
+
 	authenticator    *Authenticator
 	requestInfo      *RequestInfoManager
 	imageInfo        *ImageInfoManager
 	imageConfig      *ImageConfigFetcher
+	imageConfigBlob  *ImageConfigBlobFetcher
 	outputFileInfo   *OutputFileManager
+	blobCache        *BlobCache
 	httpClientCreate HttpClientFn
 	initialized      bool
 }
@@ -37,9 +55,15 @@ func (layer *LayerDownloader) Initialize(entry *EntryPoint) {
 	if entry.ImageConfigFetcher == nil {
 		panic("LayerDownloader init failed, EntryPoint's ImageConfigFetcher is nil")
 	}
+	if entry.ImageConfigBlobFetcher == nil {
+		panic("LayerDownloader init failed, EntryPoint's ImageConfigBlobFetcher is nil")
+	}
 	if entry.OutputFileManager == nil {
 		panic("LayerDownloader init failed, EntryPoint's outputFileInfo is nil")
 	}
+	if entry.BlobCache == nil {
+		panic("LayerDownloader init failed, EntryPoint's BlobCache is nil")
+	}
 	if entry.HttpClientFnPtr == nil {
 		panic("LayerDownloader init failed, EntryPoint's httpClientFnPtr is nil")
 	}
@@ -47,7 +71,9 @@ func (layer *LayerDownloader) Initialize(entry *EntryPoint) {
 	layer.requestInfo = entry.RequestInfoManager
 	layer.imageInfo = entry.ImageInfoManager
 	layer.imageConfig = entry.ImageConfigFetcher
+	layer.imageConfigBlob = entry.ImageConfigBlobFetcher
 	layer.outputFileInfo = entry.OutputFileManager
+	layer.blobCache = entry.BlobCache
 	layer.httpClientCreate = *entry.HttpClientFnPtr
 	layer.initialized = true
 }
@@ -59,115 +85,375 @@ func (layer *LayerDownloader) InitializeCheck() {
 	panic("LayerDownloader not init")
 }
 
+func (layer *LayerDownloader) ApplyConfig(config *cli.Config) error {
+	if config == nil {
+		return fmt.Errorf("layerDownloader: ApplyConfig Failed, Config object is nil")
+	}
+	layer.parallel = config.Parallel()
+	layer.retries = config.Retries()
+	layer.retryWait = config.RetryWait()
+	return nil
+}
+
 func (layer *LayerDownloader) Run() error {
-	client := layer.httpClientCreate()
 	imageinfo := layer.imageInfo
-	outputFileInfo := layer.outputFileInfo
-	fmt.Println("Pulling from ", imageinfo.FullName())
+	progress := NewMultiProgress(os.Stderr)
+	progress.Printf("Pulling from  %s\n", imageinfo.FullName())
 	imageConfig := layer.imageConfig
 	blobDigestWithType := imageConfig.BlobDigestWithType()
-	totalDownload := len(blobDigestWithType)
-	requestInfo := layer.requestInfo
-	authenticator := layer.authenticator
-	index := 0
-	for blobDigest, mediaType := range blobDigestWithType {
-		// Should HEAD first,but I don't want do it (:
-		layerBlobURL := fmt.Sprintf("%s/v2/%s/%s/blobs/%s",
-			requestInfo.RegistryEndpoint(),
-			requestInfo.Repository(),
-			requestInfo.ImageName(),
-			blobDigest)
-		req, err := http.NewRequest(http.MethodGet, layerBlobURL, nil)
+	if err := layer.collectDiffIDs(); err != nil {
+		return err
+	}
+	blobDigests := layer.uniqueBlobDigests()
+	totalDownload := len(blobDigests)
+	parallel := layer.parallel
+	if parallel <= 0 || parallel > totalDownload {
+		parallel = totalDownload
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	// The workers share the client, the lab clients share a resolver cache
+	// which is not safe for concurrent use by several clients
+	client := layer.httpClientCreate()
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				blobDigest := blobDigests[index]
+				name := fmt.Sprintf("[%d/%d]%s",
+					index+1,
+					totalDownload,
+					blobDigest.Encoded()[:12])
+				bar := progress.AddBytesBar(imageConfig.BlobDigestSize(blobDigest), name)
+				err := layer.download(ctx, client, blobDigest, blobDigestWithType[blobDigest], bar)
+				if errors.Is(err, errCachedBlobCorrupted) {
+					// The corrupted blob is removed from the cache, fetch it again
+					err = layer.download(ctx, client, blobDigest, blobDigestWithType[blobDigest], bar)
+				}
+				// The connection failed or broke in the middle of the blob, a resumable layer
+				// continues from its download file. The transport leaves these errors to this loop,
+				// so a layer gets retries+1 attempts.
+				for attempt := 1; attempt <= layer.retries && transientError(err) && ctx.Err() == nil; attempt++ {
+					wait := retryBackoff(layer.retryWait, attempt)
+					progress.Printf("Retrying layer %s in %s (%d/%d): %s\n",
+						blobDigest.Encoded()[:12], wait.Round(time.Millisecond), attempt, layer.retries, err)
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+					}
+					err = layer.download(ctx, client, blobDigest, blobDigestWithType[blobDigest], bar)
+				}
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("layer %s: %w", blobDigest, err)
+						cancel()
+					})
+					continue
+				}
+				progress.Finish(bar)
+			}
+		}()
+	}
+	progress.Start()
+dispatch:
+	for index := range blobDigests {
+		select {
+		case jobs <- index:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	progress.Stop()
+	return firstErr
+}
+
+// collectDiffIDs pairs each layer blob of the manifest with the diff ID
+// of the image config, they are listed in the same order.
+func (layer *LayerDownloader) collectDiffIDs() error {
+	blobDigests := layer.imageConfig.BlobDigests()
+	diffIDs := layer.imageConfigBlob.DiffIDs()
+	if len(blobDigests) != len(diffIDs) {
+		return fmt.Errorf("manifest has %d layers but image config has %d diff IDs",
+			len(blobDigests),
+			len(diffIDs))
+	}
+	layer.diffIDs = map[digest.Digest]digest.Digest{}
+	for index, blobDigest := range blobDigests {
+		if err := blobDigest.Validate(); err != nil {
+			return fmt.Errorf("layer %s: %w", blobDigest, err)
+		}
+		if err := diffIDs[index].Validate(); err != nil {
+			return fmt.Errorf("layer %s: diff ID %s: %w", blobDigest, diffIDs[index], err)
+		}
+		layer.diffIDs[blobDigest] = diffIDs[index]
+	}
+	return nil
+}
+
+// uniqueBlobDigests keeps the manifest order, a blob listed several
+// times (e.g. empty layers) only needs to be downloaded once.
+func (layer *LayerDownloader) uniqueBlobDigests() []digest.Digest {
+	seen := map[digest.Digest]bool{}
+	result := []digest.Digest{}
+	for _, blobDigest := range layer.imageConfig.BlobDigests() {
+		if seen[blobDigest] {
+			continue
+		}
+		seen[blobDigest] = true
+		result = append(result, blobDigest)
+	}
+	return result
+}
+
+// download streams the blob through the digest verifier and the decompressor
+// straight into the layer file. The compressed content is only kept in a
+// download file when the layer is worth resuming.
+// The OCI layout keeps the blob as pulled, it is only decompressed to be verified.
+func (layer *LayerDownloader) download(ctx context.Context, client *http.Client, blobDigest digest.Digest, mediaType string, bar *progressbar.ProgressBar) (err error) {
+	outputFileInfo := layer.outputFileInfo
+	diffID := layer.diffIDs[blobDigest]
+	size := layer.imageConfig.BlobDigestSize(blobDigest)
+	layerType := layerCompression(mediaType)
+	switch layerType {
+	case ".tar", "gzip", "zstd":
+	default:
+		return fmt.Errorf("layer mediaType %s not support now", mediaType)
+	}
+	// The layer file holds the blob itself, not its uncompressed content
+	raw := layerType == ".tar" || outputFileInfo.Format() == FormatOCI
+	writeFileName, err := outputFileInfo.LayerFileNameByBlobSum(blobDigest.Encoded())
+	if err != nil {
+		return err
+	}
+	downloadFileName := writeFileName + ".download"
+	layerFileDigest := diffID
+	if raw {
+		layerFileDigest = blobDigest
+	}
+	if layer.downloaded(writeFileName, downloadFileName) {
+		if layer.verifyLayerFile(writeFileName, layerFileDigest) {
+			bar.Set64(size)
+			return nil
+		}
+	}
+	os.Remove(writeFileName)
+	cached, fromCache := layer.blobCache.Open(blobDigest)
+	// A raw layer is written to the download file directly,
+	// so it can always be resumed without any extra copy.
+	resumable := !fromCache && (raw || size >= resumableLayerSize)
+	var fw *os.File
+	var offset int64
+	if resumable {
+		// The download file is kept on failure, next run will resume from it
+		fw, err = os.OpenFile(downloadFileName, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
 			return err
 		}
-		authenticator.Authorize(req)
-		resp, err := client.Do(req)
+		defer fw.Close()
+		offset, err = fw.Seek(0, io.SeekEnd)
 		if err != nil {
 			return err
 		}
-		defer resp.Body.Close()
-		prefixMessage := fmt.Sprintf("[%d/%d]%s: Downloading ",
-			index+1,
-			totalDownload,
-			blobDigest.Encoded()[:12])
-		bar := progressbar.DefaultBytes(
-			imageConfig.BlobDigestSize(blobDigest),
-			prefixMessage,
-		)
-		writeFileName, err := outputFileInfo.LayerFileNameByBlobSum(blobDigest.Encoded())
+	} else {
+		os.Remove(downloadFileName)
+	}
+	var src io.Reader
+	if fromCache {
+		defer cached.Close()
+		bar.Set64(size)
+		src = cached
+	} else {
+		var body io.ReadCloser
+		body, offset, err = layer.fetch(ctx, client, blobDigest, offset)
 		if err != nil {
 			return err
 		}
-		downloadFileName := writeFileName + ".download"
-		fw, err := os.Create(downloadFileName)
-		if err != nil {
+		defer body.Close()
+		bar.Set64(offset)
+		src = io.TeeReader(body, bar)
+	}
+	if fw != nil {
+		if err := fw.Truncate(offset); err != nil {
 			return err
 		}
-		_, err = io.Copy(io.MultiWriter(fw, bar), resp.Body)
-		if err != nil {
-			fw.Close()
+		if _, err := fw.Seek(offset, io.SeekStart); err != nil {
 			return err
 		}
-		layerType := string(mediaType[len(mediaType)-4:])
-		switch layerType {
-		case ".tar":
-			fw.Close()
-			os.Rename(downloadFileName, writeFileName)
-		case "gzip":
-			_, err = fw.Seek(0, io.SeekStart)
-			if err != nil {
-				fw.Close()
-				return err
-			}
-			gr, err := gzip.NewReader(fw)
-			if err != nil {
-				fw.Close()
-				return err
-			}
-			defer gr.Close()
-			tw, err := outputFileInfo.LayerFDByBlobSum(blobDigest.Encoded())
-			if err != nil {
-				fw.Close()
-				return err
-			}
-			defer tw.Close()
-			_, err = io.Copy(tw, gr)
-			if err != nil {
-				fmt.Println(err)
-				return err
-			}
-			fw.Close()
-		case "zstd":
-			_, err = fw.Seek(0, io.SeekStart)
-			if err != nil {
-				fw.Close()
-				return err
-			}
-			gr, err := zstd.NewReader(fw)
-			if err != nil {
-				fw.Close()
-				return err
-			}
-			defer gr.Close()
-			tw, err := outputFileInfo.LayerFDByBlobSum(blobDigest.Encoded())
-			if err != nil {
-				fw.Close()
-				return err
-			}
-			defer tw.Close()
-			_, err = io.Copy(tw, gr)
+		// Replay the content fetched by a previous run, then append the rest
+		src = io.MultiReader(io.NewSectionReader(fw, 0, offset), io.TeeReader(src, fw))
+	}
+	blobVerifier := blobDigest.Verifier()
+	diffIDVerifier := diffID.Verifier()
+	blobWriters := []io.Writer{blobVerifier}
+	var dst io.Writer = diffIDVerifier
+	if fw == nil || !raw {
+		defer func() {
 			if err != nil {
-				fw.Close()
-				return err
+				os.Remove(writeFileName)
 			}
+		}()
+		tw, err := outputFileInfo.LayerFDByBlobSum(blobDigest.Encoded())
+		if err != nil {
+			return err
+		}
+		defer tw.Close()
+		if raw {
+			blobWriters = append(blobWriters, tw)
+		} else {
+			dst = io.MultiWriter(tw, diffIDVerifier)
+		}
+	}
+	if !fromCache && layer.blobCache.Enabled() {
+		cacheWriter, cacheErr := layer.blobCache.Create(blobDigest)
+		if cacheErr == nil {
+			defer func() {
+				if err != nil {
+					cacheWriter.Discard()
+					return
+				}
+				cacheWriter.Commit()
+			}()
+			blobWriters = append(blobWriters, cacheWriter)
+		}
+	}
+	blobReader := io.TeeReader(src, io.MultiWriter(blobWriters...))
+	decompressErr := decompressLayer(dst, blobReader, mediaType)
+	// The decompressor may stop before the end of the blob
+	if _, err := io.Copy(io.Discard, blobReader); err != nil {
+		return err
+	}
+	if !blobVerifier.Verified() {
+		if fromCache {
+			cached.Close()
+			layer.blobCache.Remove(blobDigest)
+			return errCachedBlobCorrupted
+		}
+		// Resuming from a corrupted download file would never succeed
+		if fw != nil {
 			fw.Close()
-		default:
-			fw.Close()
-			return fmt.Errorf("layer mediaType %s not support now", mediaType)
+			os.Remove(downloadFileName)
 		}
-		os.Remove(downloadFileName)
-		index++
+		return fmt.Errorf("downloaded content does not match the manifest digest")
+	}
+	if decompressErr != nil {
+		return decompressErr
+	}
+	if !diffIDVerifier.Verified() {
+		return fmt.Errorf("uncompressed content does not match diff ID %s", diffID)
+	}
+	if fw == nil {
+		return nil
+	}
+	fw.Close()
+	if raw {
+		return os.Rename(downloadFileName, writeFileName)
+	}
+	return os.Remove(downloadFileName)
+}
+
+// layerCompression is the compression of the layer media type, empty when unknown
+func layerCompression(mediaType string) string {
+	for _, suffix := range []string{".tar", "gzip", "zstd"} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+func decompressLayer(dst io.Writer, src io.Reader, mediaType string) error {
+	var decompressor io.Reader
+	switch layerCompression(mediaType) {
+	case ".tar":
+		decompressor = src
+	case "gzip":
+		gr, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		decompressor = gr
+	case "zstd":
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		decompressor = zr
+	default:
+		return fmt.Errorf("layer mediaType %s not support now", mediaType)
+	}
+	_, err := io.Copy(dst, decompressor)
+	return err
+}
+
+// verifyLayerFile checks a layer written by a previous run.
+func (layer *LayerDownloader) verifyLayerFile(writeFileName string, expected digest.Digest) bool {
+	fr, err := os.Open(writeFileName)
+	if err != nil {
+		return false
+	}
+	defer fr.Close()
+	verifier := expected.Verifier()
+	if _, err := io.Copy(verifier, fr); err != nil {
+		return false
+	}
+	return verifier.Verified()
+}
+
+// downloaded reports whether a previous run has finished the layer,
+// the download file is only removed once the layer is written.
+func (layer *LayerDownloader) downloaded(writeFileName string, downloadFileName string) bool {
+	if _, err := os.Stat(downloadFileName); err == nil {
+		return false
+	}
+	_, err := os.Stat(writeFileName)
+	return err == nil
+}
+
+// fetch requests the blob from offset. The returned offset is 0 when the
+// registry ignores the range request and sends the whole blob.
+func (layer *LayerDownloader) fetch(ctx context.Context, client *http.Client, blobDigest digest.Digest, offset int64) (io.ReadCloser, int64, error) {
+	size := layer.imageConfig.BlobDigestSize(blobDigest)
+	if size > 0 && offset >= size {
+		return io.NopCloser(strings.NewReader("")), size, nil
+	}
+	requestInfo := layer.requestInfo
+	// Should HEAD first,but I don't want do it (:
+	layerBlobURL := fmt.Sprintf("%s/blobs/%s",
+		requestInfo.RepositoryURL(),
+		blobDigest)
+	// The network errors are retried by Run, resuming from the download file
+	req, err := http.NewRequestWithContext(withCallerRetries(ctx), http.MethodGet, layerBlobURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set(HeaderRange, fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := layer.authenticator.Do(client, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		contentRange := resp.Header.Get(HeaderContentRange)
+		if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("get layer blob failed, unexpected content range %q", contentRange)
+		}
+		return resp.Body, offset, nil
+	case http.StatusOK:
+		return resp.Body, 0, nil
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("get layer blob failed, %s", resp.Status)
 	}
-	return nil
 }
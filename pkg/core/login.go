@@ -0,0 +1,95 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+)
+
+// loginRegistry returns the endpoint of the registry of login and logout,
+// and its key in the docker config. Docker Hub is used by default.
+func loginRegistry(config *cli.Config) (string, string, error) {
+	registry := config.Registry()
+	if len(registry) == 0 {
+		registry = dockerHubDomain
+	}
+	if strings.Contains(registry, "://") {
+		u, err := url.Parse(registry)
+		if err != nil {
+			return "", "", err
+		}
+		endpoint := (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+		return endpoint, cli.CredentialsServerAddress(u.Host), nil
+	}
+	serverAddress := cli.CredentialsServerAddress(registry)
+	host := registry
+	if serverAddress == cli.DockerHubServerAddress {
+		host = defaultRegistry
+	}
+	endpoint := (&url.URL{Scheme: "https", Host: host}).String()
+	return endpoint, serverAddress, nil
+}
+
+// loginAction checks the credentials against the registry and saves them
+// in the docker config, like docker login.
+func loginAction(config *cli.Config) {
+	endpoint, serverAddress, err := loginRegistry(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	credentials := cli.Credentials{
+		UserName: config.UserName(),
+		Password: config.Password(),
+	}
+	if len(credentials.UserName) == 0 || len(credentials.Password) == 0 {
+		fmt.Println("username and password required, the password can be read with -password-stdin")
+		return
+	}
+	httpClientFn := newHttpClientFn(config)
+	entry := &EntryPoint{
+		HttpClientFnPtr:  &httpClientFn,
+		ImageInfoManager: new(ImageInfoManager),
+		RequestInfoManager: &RequestInfoManager{
+			registryEndpoints: insecureEndpoints(config, []registryEndpoint{{url: endpoint, resolve: true, pull: true}}),
+			credentials:       credentials,
+		},
+		Authenticator: new(Authenticator),
+	}
+	entry.RequestInfoManager.Initialize(entry)
+	entry.Authenticator.Initialize(entry)
+	if err := Run(entry.Authenticator); err != nil {
+		fmt.Println("login failed,", err)
+		return
+	}
+	dockerConfig, err := cli.LoadDockerConfig()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := dockerConfig.Store(serverAddress, credentials); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Login Succeeded")
+}
+
+// logoutAction removes the credentials of the registry from the docker config
+func logoutAction(config *cli.Config) {
+	_, serverAddress, err := loginRegistry(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	dockerConfig, err := cli.LoadDockerConfig()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Removing login credentials for", serverAddress)
+	if err := dockerConfig.Erase(serverAddress); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestAcceptTypes is sent when the reference may point to an index or a manifest
+var manifestAcceptTypes = strings.Join([]string{
+	v1.MediaTypeImageIndex,
+	MediaTypeDockerManifestList,
+	v1.MediaTypeImageManifest,
+	MediaTypeDockerManifest,
+	MediaTypeDockerSchema1SignedManifest,
+	MediaTypeDockerSchema1Manifest,
+}, ", ")
+
+// imageManifestAcceptTypes is sent when the reference must point to a manifest
+var imageManifestAcceptTypes = strings.Join([]string{
+	v1.MediaTypeImageManifest,
+	MediaTypeDockerManifest,
+	MediaTypeDockerSchema1SignedManifest,
+	MediaTypeDockerSchema1Manifest,
+}, ", ")
+
+func isIndexMediaType(mediaType string) bool {
+	switch mediaType {
+	case v1.MediaTypeImageIndex, MediaTypeDockerManifestList:
+		return true
+	default:
+		return false
+	}
+}
+
+func isManifestMediaType(mediaType string) bool {
+	switch mediaType {
+	case v1.MediaTypeImageManifest, MediaTypeDockerManifest:
+		return true
+	default:
+		return false
+	}
+}
+
+func isSchema1MediaType(mediaType string) bool {
+	switch mediaType {
+	case MediaTypeDockerSchema1Manifest, MediaTypeDockerSchema1SignedManifest:
+		return true
+	default:
+		return false
+	}
+}
+
+// responseMediaType returns the Content-Type of a manifest response.
+// Some registries serve manifests as plain json,
+// the media type is read from the manifest itself then.
+func responseMediaType(contentType string, body []byte) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		switch mediaType {
+		case "application/json", "text/plain", "application/octet-stream":
+		default:
+			return mediaType
+		}
+	}
+	var versioned struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &versioned); err != nil {
+		return mediaType
+	}
+	switch {
+	case len(versioned.MediaType) > 0:
+		return versioned.MediaType
+	case versioned.SchemaVersion == 1:
+		return MediaTypeDockerSchema1Manifest
+	case versioned.Manifests != nil:
+		return v1.MediaTypeImageIndex
+	default:
+		return v1.MediaTypeImageManifest
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"time"
 
 	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type FileDescriptor struct {
@@ -21,8 +23,10 @@ type FileDescriptor struct {
 type OutputFileManager struct {
 	outputFile     string
 	downloadFloder string
+	format         string
 
 	imageGenerateContent *ImageContentCollector
+	imageConfig          *ImageConfigFetcher
 	imageConfigBlob      *ImageConfigBlobFetcher
 	initialized          bool
 
@@ -33,19 +37,30 @@ type OutputFileManager struct {
 	layerJsons    map[string]FileDescriptor
 	layerVersions map[string]FileDescriptor
 	layers        map[string]FileDescriptor
+
+	// OCI image layout
+	ociLayout    FileDescriptor
+	index        FileDescriptor
+	manifestBlob FileDescriptor
+	blobFloders  []FileDescriptor
+	blobs        map[string]FileDescriptor
 }
 
 func (out *OutputFileManager) Initialize(entry *EntryPoint) {
 	if entry == nil {
 		panic("LayerDownloader init failed, EntryPoint is nil")
 	}
-	if entry.ImageConfigBlobFetcher == nil {
+	if entry.ImageConfigFetcher == nil {
 		panic("LayerDownloader init failed, EntryPoint's ImageConfigFetcher is nil")
 	}
+	if entry.ImageConfigBlobFetcher == nil {
+		panic("LayerDownloader init failed, EntryPoint's ImageConfigBlobFetcher is nil")
+	}
 	if entry.ImageContentCollector == nil {
 		panic("LayerDownloader init failed, EntryPoint's ImageContentCollector is nil")
 	}
 	out.imageGenerateContent = entry.ImageContentCollector
+	out.imageConfig = entry.ImageConfigFetcher
 	out.imageConfigBlob = entry.ImageConfigBlobFetcher
 	out.initialized = true
 }
@@ -58,6 +73,24 @@ func (out *OutputFileManager) InitializeCheck() {
 }
 
 func (out *OutputFileManager) Run() error {
+	if out.format == FormatOCI {
+		out.prepareOCILayout()
+	} else {
+		out.prepareDockerLayout()
+	}
+	if err := out.CreateFloder(); err != nil {
+		return err
+	}
+	if err := out.imageConfigBlob.WriteToFile(); err != nil {
+		return err
+	}
+	if err := out.imageGenerateContent.WriteToFile(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (out *OutputFileManager) prepareDockerLayout() {
 	out.manifest = FileDescriptor{
 		Name:           filepath.Join(out.DownloadFloder(), "manifest.json"),
 		CreateTime:     out.imageConfigBlob.UTC0Time(),
@@ -100,30 +133,81 @@ func (out *OutputFileManager) Run() error {
 			LastModifyTime: out.imageConfigBlob.CreatedTime(),
 		}
 	}
-	if err := out.CreateFloder(); err != nil {
-		return err
+}
+
+// prepareOCILayout lays out the blobs by digest, a manifest.json is still
+// written next to index.json so older docker engines can load the tar.
+func (out *OutputFileManager) prepareOCILayout() {
+	blobsFloder := filepath.Join(out.DownloadFloder(), "blobs")
+	blobsAlgorithmFloder := filepath.Join(blobsFloder, digest.SHA256.String())
+	out.ociLayout = FileDescriptor{
+		Name:           filepath.Join(out.DownloadFloder(), v1.ImageLayoutFile),
+		CreateTime:     out.imageConfigBlob.UTC0Time(),
+		LastModifyTime: out.imageConfigBlob.UTC0Time(),
 	}
-	if err := out.imageConfigBlob.WriteToFile(); err != nil {
-		return err
+	out.index = FileDescriptor{
+		Name:           filepath.Join(out.DownloadFloder(), v1.ImageIndexFile),
+		CreateTime:     out.imageConfigBlob.UTC0Time(),
+		LastModifyTime: out.imageConfigBlob.UTC0Time(),
 	}
-	if err := out.imageGenerateContent.WriteToFile(); err != nil {
-		return err
+	out.manifest = FileDescriptor{
+		Name:           filepath.Join(out.DownloadFloder(), "manifest.json"),
+		CreateTime:     out.imageConfigBlob.UTC0Time(),
+		LastModifyTime: out.imageConfigBlob.UTC0Time(),
+	}
+	out.blobFloders = []FileDescriptor{
+		{
+			Name:           blobsFloder,
+			CreateTime:     out.imageConfigBlob.CreatedTime(),
+			LastModifyTime: out.imageConfigBlob.CreatedTime(),
+		},
+		{
+			Name:           blobsAlgorithmFloder,
+			CreateTime:     out.imageConfigBlob.CreatedTime(),
+			LastModifyTime: out.imageConfigBlob.CreatedTime(),
+		},
+	}
+	out.manifestBlob = FileDescriptor{
+		Name:           filepath.Join(blobsAlgorithmFloder, out.imageConfig.ManifestDescriptor().Digest.Encoded()),
+		CreateTime:     out.imageConfigBlob.CreatedTime(),
+		LastModifyTime: out.imageConfigBlob.CreatedTime(),
+	}
+	out.config = FileDescriptor{
+		Name:           filepath.Join(blobsAlgorithmFloder, out.imageConfigBlob.ConfigDigest()),
+		CreateTime:     out.imageConfigBlob.CreatedTime(),
+		LastModifyTime: out.imageConfigBlob.CreatedTime(),
+	}
+	out.blobs = map[string]FileDescriptor{}
+	for _, blobDigest := range out.imageConfig.BlobDigests() {
+		out.blobs[blobDigest.Encoded()] = FileDescriptor{
+			Name:           filepath.Join(blobsAlgorithmFloder, blobDigest.Encoded()),
+			CreateTime:     out.imageConfigBlob.CreatedTime(),
+			LastModifyTime: out.imageConfigBlob.CreatedTime(),
+		}
 	}
-	return nil
 }
 
 func (out *OutputFileManager) ChtimesAll() error {
-	manifest := out.manifest
-	if err := os.Chtimes(manifest.Name, manifest.CreateTime, manifest.LastModifyTime); err != nil {
-		return err
+	chtimes := func(fd FileDescriptor) error {
+		if len(fd.Name) == 0 {
+			return nil
+		}
+		return os.Chtimes(fd.Name, fd.CreateTime, fd.LastModifyTime)
 	}
-	repositories := out.repositories
-	if err := os.Chtimes(repositories.Name, repositories.CreateTime, repositories.LastModifyTime); err != nil {
-		return err
+	for _, fd := range []FileDescriptor{out.manifest, out.repositories, out.config, out.ociLayout, out.index, out.manifestBlob} {
+		if err := chtimes(fd); err != nil {
+			return err
+		}
 	}
-	config := out.config
-	if err := os.Chtimes(config.Name, config.CreateTime, config.LastModifyTime); err != nil {
-		return err
+	for _, blob := range out.blobs {
+		if err := chtimes(blob); err != nil {
+			return err
+		}
+	}
+	for _, blobFloder := range out.blobFloders {
+		if err := chtimes(blobFloder); err != nil {
+			return err
+		}
 	}
 	for _, layerJson := range out.layerJsons {
 		if err := os.Chtimes(layerJson.Name, layerJson.CreateTime, layerJson.LastModifyTime); err != nil {
@@ -160,6 +244,26 @@ func (out *OutputFileManager) ConfigFD() (*os.File, error) {
 	return os.Create(out.config.Name)
 }
 
+func (out *OutputFileManager) OCILayoutFD() (*os.File, error) {
+	return os.Create(out.ociLayout.Name)
+}
+
+func (out *OutputFileManager) IndexFD() (*os.File, error) {
+	return os.Create(out.index.Name)
+}
+
+func (out *OutputFileManager) ManifestBlobFD() (*os.File, error) {
+	return os.Create(out.manifestBlob.Name)
+}
+
+func (out *OutputFileManager) BlobFileName(d digest.Digest) string {
+	return filepath.Join(out.downloadFloder, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+func (out *OutputFileManager) BlobFD(d digest.Digest) (*os.File, error) {
+	return os.Create(out.BlobFileName(d))
+}
+
 func (out *OutputFileManager) LayerJsonFDByV1Id(v1id string) (*os.File, error) {
 	fd, ok := out.layerJsons[v1id]
 	if !ok {
@@ -193,6 +297,13 @@ func (out *OutputFileManager) LayerFileNameByV1Id(v1id string) (string, error) {
 }
 
 func (out *OutputFileManager) LayerFileNameByBlobSum(blobsum string) (string, error) {
+	if out.format == FormatOCI {
+		fd, ok := out.blobs[blobsum]
+		if !ok {
+			return "<nil>", fmt.Errorf("%s blob info not found", blobsum)
+		}
+		return fd.Name, nil
+	}
 	v1ids, ok := out.imageGenerateContent.GetV1IDsByBlobSum(blobsum)
 	if !ok || len(v1ids) == 0 {
 		return "<nil>", fmt.Errorf("%s v1id info not found", blobsum)
@@ -201,6 +312,13 @@ func (out *OutputFileManager) LayerFileNameByBlobSum(blobsum string) (string, er
 }
 
 func (out *OutputFileManager) LayerFDByBlobSum(blobsum string) (*os.File, error) {
+	if out.format == FormatOCI {
+		fd, ok := out.blobs[blobsum]
+		if !ok {
+			return nil, fmt.Errorf("%s blob info not found", blobsum)
+		}
+		return os.Create(fd.Name)
+	}
 	v1ids, ok := out.imageGenerateContent.GetV1IDsByBlobSum(blobsum)
 	if !ok || len(v1ids) == 0 {
 		return nil, fmt.Errorf("%s v1id info not found", blobsum)
@@ -212,27 +330,116 @@ func (out *OutputFileManager) ApplyConfig(config *cli.Config) error {
 	if config == nil {
 		return fmt.Errorf("outputFileManager: ApplyConfig Failed, Config object is nil")
 	}
+	switch config.Format() {
+	case FormatDocker, FormatOCI:
+		out.format = config.Format()
+	default:
+		return fmt.Errorf("format %s not support", config.Format())
+	}
 	outputFile := config.OutputFile()
 	if len(outputFile) > 0 {
 		out.outputFile = outputFile
 	} else {
-		out.outputFile = fmt.Sprintf("%d.tar",
-			time.Now().Unix())
+		out.outputFile = defaultOutputFile(config.Images())
 	}
-	out.downloadFloder = fmt.Sprintf("%s.%d",
-		out.outputFile,
-		time.Now().Unix())
+	// Keep the staging folder name stable, so an interrupted pull
+	// can be resumed by running the same command again.
+	out.downloadFloder = fmt.Sprintf("%s.partial",
+		out.outputFile)
 	return nil
 }
 
+// defaultOutputFile names the tar after the images, the same command
+// gets the same staging folder and resumes an interrupted pull.
+func defaultOutputFile(images []string) string {
+	return outputFileReplacer.Replace(strings.Join(images, "+")) + ".tar"
+}
+
+// The characters of the references not kept in the default file names
+var outputFileReplacer = strings.NewReplacer("/", "_", ":", "_", "@", "_")
+
 func (out *OutputFileManager) OutputFile() string {
 	return out.outputFile
 }
 
+func (out *OutputFileManager) Format() string {
+	return out.format
+}
+
 func (out *OutputFileManager) DownloadFloder() string {
 	return out.downloadFloder
 }
 
+// ExpectedFiles returns the paths relative to the staging folder
+// of the files and folders written for this image.
+func (out *OutputFileManager) ExpectedFiles() map[string]bool {
+	expected := map[string]bool{}
+	add := func(name string) {
+		if len(name) == 0 {
+			return
+		}
+		rel, err := filepath.Rel(out.downloadFloder, name)
+		if err != nil {
+			return
+		}
+		expected[rel] = true
+	}
+	for _, fd := range []FileDescriptor{out.manifest, out.repositories, out.config, out.ociLayout, out.index, out.manifestBlob} {
+		add(fd.Name)
+	}
+	for _, fds := range [][]FileDescriptor{out.layerFloders, out.blobFloders} {
+		for _, fd := range fds {
+			add(fd.Name)
+		}
+	}
+	for _, fds := range []map[string]FileDescriptor{out.layerJsons, out.layerVersions, out.layers, out.blobs} {
+		for _, fd := range fds {
+			add(fd.Name)
+		}
+	}
+	for _, fds := range []map[string]FileDescriptor{out.layers, out.blobs} {
+		for _, fd := range fds {
+			add(fd.Name + ".download")
+		}
+	}
+	return expected
+}
+
+// CleanFloder removes the files left by a previous pull of another image,
+// the staging folder may be reused when the same output file is given.
+func (out *OutputFileManager) CleanFloder(expected map[string]bool) error {
+	return out.cleanDir(out.downloadFloder, expected)
+}
+
+func (out *OutputFileManager) cleanDir(dir string, expected map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		rel, err := filepath.Rel(out.downloadFloder, name)
+		if err != nil {
+			return err
+		}
+		if !expected[rel] {
+			if err := os.RemoveAll(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.IsDir() {
+			if err := out.cleanDir(name, expected); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (out *OutputFileManager) CreateFloder() error {
 	err := os.MkdirAll(out.downloadFloder, os.ModePerm)
 	if err != nil {
@@ -244,6 +451,12 @@ func (out *OutputFileManager) CreateFloder() error {
 			return err
 		}
 	}
+	for _, blobFloder := range out.blobFloders {
+		err := os.MkdirAll(blobFloder.Name, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
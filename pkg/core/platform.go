@@ -0,0 +1,151 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The OS of the images saved when the platform only gives the architecture
+const defaultPlatformOS = "linux"
+
+// os(os.version)/arch/variant, as read and printed by containerd
+var platformOSVersion = regexp.MustCompile(`^([a-zA-Z0-9_-]+)(?:\(([^()]*)\))?$`)
+
+// The -arch keys of the arm images, the variant appended to the architecture
+var legacyArmArchitecture = regexp.MustCompile(`^(arm|arm64)(v[0-9]+)$`)
+
+// indexPlatform is a manifest of the image index, the platform is kept as listed
+type indexPlatform struct {
+	platform v1.Platform
+	digest   digest.Digest
+}
+
+// parsePlatform reads os[(os.version)][/arch[/variant]], a single component
+// is an architecture when it is not a known OS, linux is used then.
+// The -arch keys like armv7 and arm64v8 are split into arch/variant.
+func parsePlatform(s string) (v1.Platform, error) {
+	var platform v1.Platform
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) == 0 || len(parts) > 3 || len(parts[0]) == 0 {
+		return platform, fmt.Errorf("invalid platform %q, os/arch[/variant] expected", s)
+	}
+	match := platformOSVersion.FindStringSubmatch(parts[0])
+	if match == nil {
+		return platform, fmt.Errorf("invalid platform %q, invalid os %q", s, parts[0])
+	}
+	if len(parts) == 1 && len(match[2]) == 0 && !isKnownOS(match[1]) {
+		platform.OS = defaultPlatformOS
+		platform.Architecture = match[1]
+		if legacy := legacyArmArchitecture.FindStringSubmatch(strings.ToLower(match[1])); legacy != nil {
+			platform.Architecture = legacy[1]
+			platform.Variant = legacy[2]
+		}
+		return normalizePlatform(platform), nil
+	}
+	platform.OS = match[1]
+	platform.OSVersion = match[2]
+	if len(parts) > 1 {
+		platform.Architecture = parts[1]
+	}
+	if len(parts) > 2 {
+		platform.Variant = parts[2]
+	}
+	return normalizePlatform(platform), nil
+}
+
+func isKnownOS(os string) bool {
+	switch strings.ToLower(os) {
+	case "aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+		"linux", "macos", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows":
+		return true
+	default:
+		return false
+	}
+}
+
+// normalizePlatform applies the containerd rules, so x86_64 is amd64
+// and arm64/v8 is arm64.
+func normalizePlatform(platform v1.Platform) v1.Platform {
+	platform.OS = strings.ToLower(platform.OS)
+	if platform.OS == "macos" {
+		platform.OS = "darwin"
+	}
+	platform.Architecture = strings.ToLower(platform.Architecture)
+	platform.Variant = strings.ToLower(platform.Variant)
+	switch platform.Architecture {
+	case "i386":
+		platform.Architecture = "386"
+		platform.Variant = ""
+	case "x86_64", "x86-64", "amd64":
+		platform.Architecture = "amd64"
+		if platform.Variant == "v1" {
+			platform.Variant = ""
+		}
+	case "aarch64", "arm64":
+		platform.Architecture = "arm64"
+		switch platform.Variant {
+		case "8", "v8", "v8.0":
+			platform.Variant = ""
+		}
+	case "armhf":
+		platform.Architecture = "arm"
+		platform.Variant = "v7"
+	case "armel":
+		platform.Architecture = "arm"
+		platform.Variant = "v6"
+	case "arm":
+		switch platform.Variant {
+		case "", "7":
+			platform.Variant = "v7"
+		case "5", "6", "8":
+			platform.Variant = "v" + platform.Variant
+		}
+	}
+	return platform
+}
+
+// formatPlatform prints os[(os.version)]/arch[/variant]
+func formatPlatform(platform v1.Platform) string {
+	os := platform.OS
+	if len(platform.OSVersion) > 0 {
+		os = fmt.Sprintf("%s(%s)", os, platform.OSVersion)
+	}
+	if len(platform.Architecture) == 0 {
+		return os
+	}
+	if len(platform.Variant) == 0 {
+		return fmt.Sprintf("%s/%s", os, platform.Architecture)
+	}
+	return fmt.Sprintf("%s/%s/%s", os, platform.Architecture, platform.Variant)
+}
+
+// matchPlatform checks an entry of the index against the wanted platform.
+// An os.version matches the versions it is a prefix of, so 10.0.17763
+// selects the 10.0.17763.* windows builds.
+func matchPlatform(want v1.Platform, have v1.Platform) bool {
+	have = normalizePlatform(have)
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return false
+	}
+	if len(want.Variant) > 0 && want.Variant != have.Variant {
+		return false
+	}
+	if len(want.OSVersion) > 0 {
+		return have.OSVersion == want.OSVersion ||
+			strings.HasPrefix(have.OSVersion, want.OSVersion+".")
+	}
+	return true
+}
+
+// legacyArchitecture is the key used by -arch, the architecture and the variant
+// of a linux image concatenated, like amd64 or arm64v8.
+func legacyArchitecture(platform v1.Platform) string {
+	if platform.OS != defaultPlatformOS {
+		return ""
+	}
+	return platform.Architecture + platform.Variant
+}
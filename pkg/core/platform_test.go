@@ -0,0 +1,109 @@
+package core
+
+import (
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		input string
+		want  v1.Platform
+	}{
+		{"amd64", v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{"x86_64", v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{"linux/amd64", v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{"linux/amd64/v1", v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{"linux/amd64/v3", v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}},
+		{"i386", v1.Platform{OS: "linux", Architecture: "386"}},
+		{"arm", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{"linux/arm", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{"linux/arm/7", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{"linux/arm/v6", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{"linux/arm/5", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v5"}},
+		{"armhf", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{"armel", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{"armv7", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{"armv6", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{"arm64", v1.Platform{OS: "linux", Architecture: "arm64"}},
+		{"aarch64", v1.Platform{OS: "linux", Architecture: "arm64"}},
+		{"arm64v8", v1.Platform{OS: "linux", Architecture: "arm64"}},
+		{"linux/arm64/v8", v1.Platform{OS: "linux", Architecture: "arm64"}},
+		{"linux/arm64/8", v1.Platform{OS: "linux", Architecture: "arm64"}},
+		{"linux/arm64/v9", v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v9"}},
+		{"linux", v1.Platform{OS: "linux"}},
+		{"macos/arm64", v1.Platform{OS: "darwin", Architecture: "arm64"}},
+		{"windows(10.0.17763)/amd64", v1.Platform{OS: "windows", OSVersion: "10.0.17763", Architecture: "amd64"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parsePlatform(tt.input)
+			if err != nil {
+				t.Fatalf("parsePlatform(%q) error: %v", tt.input, err)
+			}
+			if got.OS != tt.want.OS || got.OSVersion != tt.want.OSVersion ||
+				got.Architecture != tt.want.Architecture || got.Variant != tt.want.Variant {
+				t.Errorf("parsePlatform(%q) = %s, want %s", tt.input, formatPlatform(got), formatPlatform(tt.want))
+			}
+		})
+	}
+}
+
+func TestParsePlatformInvalid(t *testing.T) {
+	for _, input := range []string{"", "/amd64", "linux/arm/v7/extra", "lin ux/amd64"} {
+		t.Run(input, func(t *testing.T) {
+			if _, err := parsePlatform(input); err == nil {
+				t.Errorf("parsePlatform(%q) succeeded, want an error", input)
+			}
+		})
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	tests := []struct {
+		want  string
+		have  v1.Platform
+		match bool
+	}{
+		{"linux/arm/v7", v1.Platform{OS: "linux", Architecture: "arm"}, true},
+		{"armv7", v1.Platform{OS: "linux", Architecture: "arm"}, true},
+		{"linux/arm", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{"linux/arm/v6", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, false},
+		{"linux/arm64", v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{"linux/arm64/v8", v1.Platform{OS: "linux", Architecture: "arm64"}, true},
+		{"arm64v8", v1.Platform{OS: "linux", Architecture: "arm64"}, true},
+		{"amd64", v1.Platform{OS: "linux", Architecture: "x86_64"}, true},
+		{"amd64", v1.Platform{OS: "windows", Architecture: "amd64"}, false},
+		{"windows(10.0.17763)/amd64", v1.Platform{OS: "windows", OSVersion: "10.0.17763.5820", Architecture: "amd64"}, true},
+		{"windows(10.0.1776)/amd64", v1.Platform{OS: "windows", OSVersion: "10.0.17763.5820", Architecture: "amd64"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want+"~"+formatPlatform(tt.have), func(t *testing.T) {
+			want, err := parsePlatform(tt.want)
+			if err != nil {
+				t.Fatalf("parsePlatform(%q) error: %v", tt.want, err)
+			}
+			if got := matchPlatform(want, tt.have); got != tt.match {
+				t.Errorf("matchPlatform(%s, %s) = %v, want %v", tt.want, formatPlatform(tt.have), got, tt.match)
+			}
+		})
+	}
+}
+
+func TestLegacyArchitecture(t *testing.T) {
+	tests := []struct {
+		platform v1.Platform
+		want     string
+	}{
+		{v1.Platform{OS: "linux", Architecture: "amd64"}, "amd64"},
+		{v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, "armv7"},
+		{v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, "arm64v8"},
+		{v1.Platform{OS: "windows", Architecture: "amd64"}, ""},
+	}
+	for _, tt := range tests {
+		if got := legacyArchitecture(tt.platform); got != tt.want {
+			t.Errorf("legacyArchitecture(%s) = %q, want %q", formatPlatform(tt.platform), got, tt.want)
+		}
+	}
+}
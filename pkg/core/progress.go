@@ -0,0 +1,163 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/term"
+)
+
+const progressRefreshInterval = 100 * time.Millisecond
+
+// The progress being rendered, the messages of the pull go through it meanwhile
+var activeProgress atomic.Pointer[MultiProgress]
+
+// printf prints a message of the pull, above the progress bars when they
+// are rendered, so they don't break the redraw.
+func printf(format string, a ...any) {
+	if m := activeProgress.Load(); m != nil {
+		m.Printf(format, a...)
+		return
+	}
+	fmt.Printf(format, a...)
+}
+
+// MultiProgress renders several progress bars at once, one line per bar.
+// Bars are rendered silently and redrawn together by a single goroutine,
+// so concurrent downloads don't overwrite each other's output.
+// When the writer is not a terminal, like a CI log, nothing is redrawn
+// and a plain line is printed per finished bar.
+type MultiProgress struct {
+	sync.Mutex
+	writer io.Writer
+	live   bool
+	bars   []*progressbar.ProgressBar
+	names  map[*progressbar.ProgressBar]string
+	// The lines of the bars drawn last, redrawn in place
+	lines int
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func NewMultiProgress(w io.Writer) *MultiProgress {
+	f, isFile := w.(*os.File)
+	return &MultiProgress{
+		writer: w,
+		live:   isFile && term.IsTerminal(int(f.Fd())),
+		names:  map[*progressbar.ProgressBar]string{},
+	}
+}
+
+// AddBytesBar adds a bar shown as "<name>: Downloading"
+func (m *MultiProgress) AddBytesBar(maxBytes int64, name string) *progressbar.ProgressBar {
+	bar := progressbar.NewOptions64(
+		maxBytes,
+		progressbar.OptionSetDescription(name+": Downloading "),
+		progressbar.OptionSetWriter(io.Discard),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionShowTotalBytes(true),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionSetRenderBlankState(true),
+	)
+	m.Lock()
+	m.bars = append(m.bars, bar)
+	m.names[bar] = name
+	m.Unlock()
+	return bar
+}
+
+// Finish prints the last state of the bar once, it is not redrawn anymore
+func (m *MultiProgress) Finish(bar *progressbar.ProgressBar) {
+	bar.Finish()
+	m.Lock()
+	defer m.Unlock()
+	index := slices.Index(m.bars, bar)
+	if index < 0 {
+		return
+	}
+	m.bars = slices.Delete(m.bars, index, index+1)
+	if m.live {
+		m.clear()
+		fmt.Fprintf(m.writer, "%s\n", bar.String())
+		m.draw()
+		return
+	}
+	fmt.Fprintf(m.writer, "%s: Downloaded %s\n", m.names[bar], humanSize(bar.GetMax64()))
+}
+
+// Printf prints a message above the bars
+func (m *MultiProgress) Printf(format string, a ...any) {
+	m.Lock()
+	defer m.Unlock()
+	m.clear()
+	fmt.Fprintf(m.writer, format, a...)
+	m.draw()
+}
+
+func (m *MultiProgress) Start() {
+	activeProgress.Store(m)
+	if !m.live {
+		return
+	}
+	m.done = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go func() {
+		defer close(m.stopped)
+		ticker := time.NewTicker(progressRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.render()
+			case <-m.done:
+				m.render()
+				return
+			}
+		}
+	}()
+}
+
+func (m *MultiProgress) Stop() {
+	activeProgress.CompareAndSwap(m, nil)
+	if m.done == nil {
+		return
+	}
+	close(m.done)
+	<-m.stopped
+	m.done = nil
+}
+
+func (m *MultiProgress) render() {
+	m.Lock()
+	defer m.Unlock()
+	m.clear()
+	m.draw()
+}
+
+// clear moves the cursor up to the first bar and erases the bars
+func (m *MultiProgress) clear() {
+	if m.live && m.lines > 0 {
+		fmt.Fprintf(m.writer, "\033[%dA\r\033[J", m.lines)
+	}
+	m.lines = 0
+}
+
+func (m *MultiProgress) draw() {
+	if !m.live {
+		return
+	}
+	for _, bar := range m.bars {
+		fmt.Fprintf(m.writer, "\r\033[2K%s\n", bar.String())
+	}
+	m.lines = len(m.bars)
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	chinadns "github.com/excitedplus1s/gfwutils/dns"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxyFunc returns the proxy of a request: the proxy of the command line,
+// else HTTP_PROXY and HTTPS_PROXY. The hosts of NO_PROXY are reached directly.
+// HTTP CONNECT and SOCKS5 proxies are handled by the transport.
+func proxyFunc(proxyURL *url.URL) func(*http.Request) (*url.URL, error) {
+	proxyConfig := httpproxy.FromEnvironment()
+	if proxyURL != nil {
+		proxyConfig.HTTPProxy = proxyURL.String()
+		proxyConfig.HTTPSProxy = proxyURL.String()
+	}
+	proxy := proxyConfig.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// labDialContext resolves the names with the DNS servers of the lab mode,
+// like the name of the proxy. The system resolver is used when they don't
+// know the name, like a proxy of the LAN.
+func labDialContext(dnsConfig *chinadns.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		ips, err := chinadns.Client(dnsConfig).LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
@@ -0,0 +1,211 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+)
+
+// The image checked by the ratelimit action when -image is not set, the one of the Docker documentation
+const rateLimitPreviewImage = "ratelimitpreview/test"
+
+// The window of Docker Hub when the headers don't tell it
+const defaultRateLimitWindow = 6 * time.Hour
+
+// The wait between two checks of the quota when the registry has no Retry-After
+const rateLimitPollInterval = time.Minute
+
+// RateLimit is the pull quota reported by Docker Hub in the manifest responses,
+// like "RateLimit-Limit: 100;w=21600" and "RateLimit-Remaining: 76;w=21600".
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Window    time.Duration
+	// The IP or the user id the quota is counted for
+	Source string
+}
+
+// parseRateLimit reads the rate limit headers, false if the registry has no limit
+func parseRateLimit(header http.Header) (RateLimit, bool) {
+	limit, limitWindow, ok := parseRateLimitHeader(header.Get(HeaderRateLimitLimit))
+	if !ok {
+		return RateLimit{}, false
+	}
+	remaining, remainingWindow, ok := parseRateLimitHeader(header.Get(HeaderRateLimitRemaining))
+	if !ok {
+		return RateLimit{}, false
+	}
+	window := limitWindow
+	if window <= 0 {
+		window = remainingWindow
+	}
+	if window <= 0 {
+		window = defaultRateLimitWindow
+	}
+	return RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Window:    window,
+		Source:    header.Get(HeaderRateLimitSource),
+	}, true
+}
+
+// parseRateLimitHeader parses "100;w=21600", the window is in seconds
+func parseRateLimitHeader(value string) (int, time.Duration, bool) {
+	if len(value) == 0 {
+		return 0, 0, false
+	}
+	parts := strings.Split(value, ";")
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count < 0 {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || key != "w" {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			window = time.Duration(seconds) * time.Second
+		}
+	}
+	return count, window, true
+}
+
+// Low tells if a tenth or less of the quota is left
+func (limit RateLimit) Low() bool {
+	return limit.Remaining*10 <= limit.Limit
+}
+
+func (limit RateLimit) String() string {
+	return fmt.Sprintf("%d/%d pulls remaining per %s", limit.Remaining, limit.Limit, limit.Window)
+}
+
+// warnRateLimit prints a warning when the quota is almost spent
+func warnRateLimit(header http.Header) {
+	limit, ok := parseRateLimit(header)
+	if !ok || !limit.Low() {
+		return
+	}
+	fmt.Println("Warning: pull rate limit almost reached,", limit)
+}
+
+// rateLimitError explains a 429 of a manifest request
+func rateLimitError(resp *http.Response) error {
+	limit, ok := parseRateLimit(resp.Header)
+	if !ok {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return fmt.Errorf("%s, pull rate limit reached (%s), -ratelimit-wait waits for the quota", resp.Status, limit)
+}
+
+// doManifestRequest sends a manifest request, when the pull rate limit is reached
+// and wait is set, it checks the quota with HEAD requests until a pull is allowed.
+// Docker Hub doesn't count the HEAD requests.
+func doManifestRequest(client *http.Client, authenticator *Authenticator, req *http.Request, wait bool) (*http.Response, error) {
+	resp, err := authenticator.Do(client, req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || !wait {
+		return resp, err
+	}
+	limit, ok := parseRateLimit(resp.Header)
+	if !ok {
+		limit.Window = defaultRateLimitWindow
+	}
+	interval := min(rateLimitPollInterval, limit.Window)
+	if retryAfter, ok := parseRetryAfter(resp); ok && retryAfter > 0 {
+		interval = retryAfter
+	}
+	resp.Body.Close()
+	deadline := time.Now().Add(limit.Window)
+	fmt.Printf("Pull rate limit reached, waiting up to %s for the quota\n", limit.Window)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(interval):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		head := req.Clone(req.Context())
+		head.Method = http.MethodHead
+		resp, err := authenticator.Do(client, head)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			continue
+		}
+		if limit, ok := parseRateLimit(resp.Header); ok && limit.Remaining == 0 {
+			continue
+		}
+		break
+	}
+	return authenticator.Do(client, req)
+}
+
+// rateLimitAction shows the pull quota left on the registry of each image,
+// with a HEAD request which doesn't spend it.
+func rateLimitAction(config *cli.Config) {
+	images := config.Images()
+	if len(images) == 0 {
+		images = []string{rateLimitPreviewImage}
+	}
+	for _, image := range images {
+		imageConfig := config.Clone()
+		imageConfig.SetImages(nil)
+		imageConfig.SetImageInfo(image)
+		if len(images) > 1 {
+			fmt.Println("Image:", image)
+		}
+		showRateLimit(imageConfig)
+	}
+}
+
+func showRateLimit(config *cli.Config) {
+	entry := &EntryPoint{}
+	if err := entry.ApplyConfig(config); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := Run(entry.Authenticator); err != nil {
+		fmt.Println(err)
+		return
+	}
+	requestInfo := entry.RequestInfoManager
+	manifestURL := fmt.Sprintf("%s/manifests/%s",
+		requestInfo.RepositoryURL(),
+		requestInfo.Reference())
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	req.Header.Set(HeaderAccept, manifestAcceptTypes)
+	resp, err := entry.Authenticator.Do((*entry.HttpClientFnPtr)(), req)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusTooManyRequests {
+		fmt.Println("get rate limit failed,", resp.Status)
+		return
+	}
+	limit, ok := parseRateLimit(resp.Header)
+	if !ok {
+		fmt.Println("No pull rate limit reported by", requestInfo.RegistryEndpoint())
+		return
+	}
+	fmt.Println("Limit:", limit.Limit, "per", limit.Window)
+	fmt.Println("Remaining:", limit.Remaining)
+	if len(limit.Source) > 0 {
+		fmt.Println("Source:", limit.Source)
+	}
+	if limit.Low() {
+		fmt.Println("Warning: pull rate limit almost reached")
+	}
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// The grammar of github.com/distribution/reference
+var (
+	referenceDomain        = regexp.MustCompile(`^(?:\[[a-fA-F0-9:]+\]|(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*)(?::[0-9]+)?$`)
+	referencePathComponent = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	referenceTag           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+const (
+	dockerHubDomain       = "docker.io"
+	legacyDockerHubDomain = "index.docker.io"
+	officialRepository    = "library"
+	maxReferenceNameSize  = 255
+)
+
+// imageReference is a parsed domain/path[:tag][@digest] reference
+type imageReference struct {
+	domain string
+	path   string
+	tag    string
+	digest digest.Digest
+}
+
+// parseReference parses an image reference like the docker CLI does,
+// the domain is the first component when it contains . or : or is localhost,
+// docker.io is used otherwise and official images get the library/ prefix.
+func parseReference(s string) (imageReference, error) {
+	var ref imageReference
+	name, digestPart, hasDigest := strings.Cut(s, "@")
+	if hasDigest {
+		d, err := digest.Parse(digestPart)
+		if err != nil {
+			return ref, fmt.Errorf("invalid digest %s, %v", digestPart, err)
+		}
+		ref.digest = d
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.tag = name[i+1:]
+		name = name[:i]
+		if !referenceTag.MatchString(ref.tag) {
+			return ref, fmt.Errorf("invalid reference format: invalid tag %q", ref.tag)
+		}
+	}
+	if len(name) == 0 {
+		return ref, fmt.Errorf("invalid reference format: repository name is empty")
+	}
+	if len(name) > maxReferenceNameSize {
+		return ref, fmt.Errorf("invalid reference format: repository name must not be more than %d characters", maxReferenceNameSize)
+	}
+	domain, path, ok := strings.Cut(name, "/")
+	if !ok || (!strings.ContainsAny(domain, ".:") && domain != "localhost" && strings.ToLower(domain) == domain) {
+		domain, path = dockerHubDomain, name
+	}
+	if domain == legacyDockerHubDomain {
+		domain = dockerHubDomain
+	}
+	if domain == dockerHubDomain && !strings.Contains(path, "/") {
+		path = officialRepository + "/" + path
+	}
+	if !referenceDomain.MatchString(domain) {
+		return ref, fmt.Errorf("invalid reference format: invalid domain %q", domain)
+	}
+	for _, component := range strings.Split(path, "/") {
+		if referencePathComponent.MatchString(component) {
+			continue
+		}
+		if strings.ToLower(component) != component {
+			return ref, fmt.Errorf("invalid reference format: repository name must be lowercase")
+		}
+		return ref, fmt.Errorf("invalid reference format: invalid path component %q", component)
+	}
+	ref.domain = domain
+	ref.path = path
+	return ref, nil
+}
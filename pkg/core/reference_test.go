@@ -0,0 +1,64 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const testDigest = "sha256:c7c298c115a0e79e6d31c4cf5da8a7ff723bcd7d98fb26fc8bc99896d6e8869b"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		input string
+		want  imageReference
+	}{
+		{"nginx", imageReference{domain: "docker.io", path: "library/nginx"}},
+		{"nginx:1.25", imageReference{domain: "docker.io", path: "library/nginx", tag: "1.25"}},
+		{"bitnami/redis", imageReference{domain: "docker.io", path: "bitnami/redis"}},
+		{"docker.io/nginx", imageReference{domain: "docker.io", path: "library/nginx"}},
+		{"docker.io/library/nginx:latest", imageReference{domain: "docker.io", path: "library/nginx", tag: "latest"}},
+		{"index.docker.io/nginx", imageReference{domain: "docker.io", path: "library/nginx"}},
+		{"index.docker.io/bitnami/redis:7", imageReference{domain: "docker.io", path: "bitnami/redis", tag: "7"}},
+		{"localhost/app", imageReference{domain: "localhost", path: "app"}},
+		{"localhost:5000/app:dev", imageReference{domain: "localhost:5000", path: "app", tag: "dev"}},
+		{"127.0.0.1:5000/team/app", imageReference{domain: "127.0.0.1:5000", path: "team/app"}},
+		{"ghcr.io/owner/repo/image:v1", imageReference{domain: "ghcr.io", path: "owner/repo/image", tag: "v1"}},
+		{"[::1]:5000/app", imageReference{domain: "[::1]:5000", path: "app"}},
+		{"nginx@" + testDigest, imageReference{domain: "docker.io", path: "library/nginx", digest: digest.Digest(testDigest)}},
+		{"quay.io/app@" + testDigest, imageReference{domain: "quay.io", path: "app", digest: digest.Digest(testDigest)}},
+		{"nginx:1.25@" + testDigest, imageReference{domain: "docker.io", path: "library/nginx", tag: "1.25", digest: digest.Digest(testDigest)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseReference(tt.input)
+			if err != nil {
+				t.Fatalf("parseReference(%q) error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseReference(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		":latest",
+		"Nginx",
+		"docker.io/Library/nginx",
+		"nginx:-bad",
+		"nginx@sha256:short",
+		"nginx@" + testDigest[:20],
+		"registry..io/app",
+		"app//name",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if ref, err := parseReference(input); err == nil {
+				t.Errorf("parseReference(%q) = %+v, want an error", input, ref)
+			}
+		})
+	}
+}
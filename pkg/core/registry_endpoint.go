@@ -0,0 +1,117 @@
+package core
+
+import (
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+	"github.com/opencontainers/go-digest"
+)
+
+// registryEndpoint is a mirror or the upstream registry the image is pulled from
+type registryEndpoint struct {
+	// scheme://host[:port][/path]
+	url string
+	// The url is the root of the API, /v2 is not added
+	overridePath bool
+	// The repository path on this endpoint
+	repository string
+	// Resolves the tags
+	resolve bool
+	// Serves the blobs and the manifests by digest
+	pull bool
+	// The docker-credential-<helper> of the endpoint, the docker config is used when empty
+	credentialHelper string
+	// Sent with the requests to the endpoint
+	header map[string][]string
+}
+
+// apiURL is the root of the registry API
+func (endpoint *registryEndpoint) apiURL() string {
+	if endpoint.overridePath {
+		return endpoint.url
+	}
+	return endpoint.url + "/v2"
+}
+
+// repositoryURL is the root of the repository in the registry API
+func (endpoint *registryEndpoint) repositoryURL() string {
+	return endpoint.apiURL() + "/" + endpoint.repository
+}
+
+func (endpoint *registryEndpoint) host() string {
+	u, err := url.Parse(endpoint.url)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// serves tells if the endpoint answers the request of the repository,
+// like /manifests/latest or /blobs/sha256:...
+func (endpoint *registryEndpoint) serves(repositoryRequest string) bool {
+	if reference, ok := strings.CutPrefix(repositoryRequest, "/manifests/"); ok {
+		if _, err := digest.Parse(reference); err != nil {
+			return endpoint.resolve
+		}
+	}
+	return endpoint.pull
+}
+
+// configEndpoints returns the endpoints of a registries config entry for the
+// registry/path reference of the image, an insecure endpoint falls back to
+// plain HTTP.
+func configEndpoints(registryConfig *cli.RegistryConfig, endpointConfig cli.RegistryEndpointConfig, reference string, repository string) []registryEndpoint {
+	if endpointConfig.Rewrite {
+		rest := strings.TrimPrefix(strings.TrimPrefix(reference, registryConfig.Prefix), "/")
+		repository = path.Join(endpointConfig.Namespace, rest)
+	}
+	endpoint := registryEndpoint{
+		url:              endpointConfig.URL,
+		overridePath:     endpointConfig.OverridePath,
+		repository:       repository,
+		resolve:          endpointConfig.CanResolve(),
+		pull:             endpointConfig.CanPull(),
+		credentialHelper: endpointConfig.CredentialHelper,
+		header:           endpointConfig.Header,
+	}
+	endpoints := []registryEndpoint{endpoint}
+	if endpointConfig.Insecure {
+		if plain, ok := endpoint.plainHTTP(); ok {
+			endpoints = append(endpoints, plain)
+		}
+	}
+	return endpoints
+}
+
+// plainHTTP is the http variant of an https endpoint
+func (endpoint registryEndpoint) plainHTTP() (registryEndpoint, bool) {
+	rest, ok := strings.CutPrefix(endpoint.url, "https://")
+	if !ok {
+		return registryEndpoint{}, false
+	}
+	endpoint.url = "http://" + rest
+	return endpoint, true
+}
+
+// insecureEndpoints adds the plain HTTP fallback after the https endpoints
+// of the insecure registries
+func insecureEndpoints(config *cli.Config, endpoints []registryEndpoint) []registryEndpoint {
+	var result []registryEndpoint
+	for _, endpoint := range endpoints {
+		result = append(result, endpoint)
+		if !config.InsecureRegistry(endpoint.host()) {
+			continue
+		}
+		plain, ok := endpoint.plainHTTP()
+		if !ok || slices.ContainsFunc(endpoints, func(other registryEndpoint) bool {
+			return other.url == plain.url
+		}) {
+			continue
+		}
+		result = append(result, plain)
+	}
+	return result
+}
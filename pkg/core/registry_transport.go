@@ -0,0 +1,144 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+)
+
+// registryTLSError is the TLS config of a registry that can't be loaded,
+// sending the request again fails the same way.
+type registryTLSError struct {
+	host string
+	err  error
+}
+
+func (e *registryTLSError) Error() string {
+	return fmt.Sprintf("TLS config of %s: %v", e.host, e.err)
+}
+
+func (e *registryTLSError) Unwrap() error {
+	return e.err
+}
+
+type registryEndpointKey struct{}
+
+// withRegistryEndpoint marks a request sent for the registry endpoint of
+// the host, the redirects keep the mark but go to another host. The request
+// is cloned, the headers set for an endpoint don't reach the next one.
+func withRegistryEndpoint(req *http.Request, host string) *http.Request {
+	return req.Clone(context.WithValue(req.Context(), registryEndpointKey{}, host))
+}
+
+// registryEndpointRequest tells if the request goes to a registry endpoint
+func registryEndpointRequest(req *http.Request) bool {
+	host, _ := req.Context().Value(registryEndpointKey{}).(string)
+	return len(host) > 0 && host == req.URL.Host
+}
+
+// registryTransport sends the requests of a registry having TLS settings,
+// from the registries config, the certs directory or the command line, with
+// its own transport. The other requests go through the base transport.
+type registryTransport struct {
+	base        http.RoundTripper
+	registryTLS func(host string, endpoint bool) (cli.RegistryTLS, bool, error)
+	// The hosts told the lab mode doesn't apply to them, shared by the clients
+	labWarnings *sync.Map
+
+	mutex      sync.Mutex
+	transports map[string]http.RoundTripper
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || t.registryTLS == nil {
+		return t.base.RoundTrip(req)
+	}
+	transport, err := t.transport(req.URL.Host, registryEndpointRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+// transport returns the transport of the host, created on the first request
+func (t *registryTransport) transport(host string, endpoint bool) (http.RoundTripper, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := host
+	if endpoint {
+		key += " endpoint"
+	}
+	if transport, ok := t.transports[key]; ok {
+		return transport, nil
+	}
+	registryTLS, ok, err := t.registryTLS(host, endpoint)
+	if err != nil {
+		return nil, &registryTLSError{host: host, err: err}
+	}
+	if t.transports == nil {
+		t.transports = map[string]http.RoundTripper{}
+	}
+	base, isHTTPTransport := t.base.(*http.Transport)
+	if !ok || !isHTTPTransport {
+		t.transports[key] = t.base
+		return t.base, nil
+	}
+	tlsConfig, err := newTLSConfig(registryTLS)
+	if err != nil {
+		return nil, &registryTLSError{host: host, err: err}
+	}
+	transport := base.Clone()
+	// The uTLS dialer of the lab mode doesn't take the TLS config
+	if transport.DialTLSContext != nil {
+		transport.DialTLSContext = nil
+		if _, warned := t.labWarnings.LoadOrStore(host, true); !warned {
+			printf("Warning: %s has its own TLS settings, the lab mode doesn't apply to it\n", host)
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+	t.transports[key] = transport
+	return transport, nil
+}
+
+// newTLSConfig trusts the CA files besides the system ones and presents the
+// client certificates
+func newTLSConfig(registryTLS cli.RegistryTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: registryTLS.SkipVerify,
+	}
+	if len(registryTLS.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range registryTLS.CAFiles {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", caFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	for _, clientCertificate := range registryTLS.ClientCertificates {
+		// Without a key file, the key is in the certificate file
+		keyFile := clientCertificate.KeyFile
+		if len(keyFile) == 0 {
+			keyFile = clientCertificate.CertFile
+		}
+		certificate, err := tls.LoadX509KeyPair(clientCertificate.CertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, certificate)
+	}
+	return tlsConfig, nil
+}
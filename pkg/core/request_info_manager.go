@@ -3,13 +3,22 @@ package core
 import (
 	"fmt"
 	"net/url"
+	"slices"
+	"strings"
 
 	cli "github.com/excitedplus1s/docker-tar/pkg/cli"
+	"github.com/opencontainers/go-digest"
 )
 
 type RequestInfoManager struct {
-	registryEndpoint string
-	imageInfo        *ImageInfoManager
+	// The mirrors in order, then the upstream registry
+	registryEndpoints []registryEndpoint
+	imageInfo         *ImageInfoManager
+	// The credentials of the command line, for the registry of the image
+	// and the mirrors of the command line
+	credentials cli.Credentials
+	// The credentials of the docker config by endpoint
+	endpointCredentials map[string]cli.Credentials
 
 	initialized bool
 }
@@ -40,34 +49,145 @@ func (req *RequestInfoManager) ApplyConfig(config *cli.Config) error {
 	if config == nil {
 		return fmt.Errorf("requestInfoManager: ApplyConfig Failed, Config object is nil")
 	}
-	registryEndpoint := config.MirrorRegistry()
+	repository := req.imageInfo.Path()
+	req.registryEndpoints = nil
+	// The hosts the user gave on the command line, never the ones of a config file
+	credentialHosts := []string{req.imageInfo.Registry()}
+	// The mirrors of the command line come first
+	for _, mirror := range config.MirrorRegistries() {
+		mirrorURL, err := mirrorEndpoint(mirror)
+		if err != nil {
+			return err
+		}
+		endpoint := registryEndpoint{url: mirrorURL}
+		credentialHosts = append(credentialHosts, endpoint.host())
+		req.addRegistryEndpoints(registryEndpoint{
+			url:        mirrorURL,
+			repository: repository,
+			resolve:    true,
+			pull:       true,
+		})
+	}
+	// The upstream registry is the last fallback
+	u := &url.URL{
+		Scheme: "https",
+		Host:   req.imageInfo.Registry(),
+	}
+	upstream := []registryEndpoint{{
+		url:        u.String(),
+		repository: repository,
+		resolve:    true,
+		pull:       true,
+	}}
+	reference := cli.CanonicalRegistry(req.imageInfo.Registry() + "/" + repository)
+	if registryConfig, ok := config.RegistryConfig(reference); ok {
+		if registryConfig.Blocked {
+			return fmt.Errorf("pulling from %s is blocked by the registries config", reference)
+		}
+		for _, mirror := range registryConfig.Mirrors {
+			if mirror.TagOnly && len(req.imageInfo.Digest()) > 0 {
+				continue
+			}
+			req.addRegistryEndpoints(configEndpoints(registryConfig, mirror, reference, repository)...)
+		}
+		if registryConfig.Upstream != nil {
+			upstream = configEndpoints(registryConfig, *registryConfig.Upstream, reference, repository)
+		}
+	}
+	for i := range upstream {
+		upstream[i].resolve, upstream[i].pull = true, true
+	}
+	req.addRegistryEndpoints(upstream...)
+	req.registryEndpoints = insecureEndpoints(config, req.registryEndpoints)
+	return req.lookupCredentials(credentialHosts)
+}
 
-	if len(registryEndpoint) == 0 {
+// mirrorEndpoint adds https to a mirror given without scheme
+func mirrorEndpoint(mirror string) (string, error) {
+	parsedURL, err := url.Parse(mirror)
+	if err != nil {
+		return "", err
+	}
+	if len(parsedURL.Scheme) == 0 {
 		u := &url.URL{
 			Scheme: "https",
-			Host:   req.imageInfo.Registry(),
+			Host:   mirror,
 		}
-		req.registryEndpoint = u.String()
-	} else {
-		parsedURL, err := url.Parse(registryEndpoint)
-		if err != nil {
-			return err
+		return u.String(), nil
+	}
+	return strings.TrimSuffix(mirror, "/"), nil
+}
+
+func (req *RequestInfoManager) addRegistryEndpoints(endpoints ...registryEndpoint) {
+	for _, endpoint := range endpoints {
+		if slices.ContainsFunc(req.registryEndpoints, func(added registryEndpoint) bool {
+			return added.url == endpoint.url
+		}) {
+			continue
 		}
-		if len(parsedURL.Scheme) == 0 {
-			u := &url.URL{
-				Scheme: "https",
-				Host:   registryEndpoint,
-			}
-			req.registryEndpoint = u.String()
+		req.registryEndpoints = append(req.registryEndpoints, endpoint)
+	}
+}
+
+// lookupCredentials reads the credentials of the endpoints from their helper
+// or the docker config. The credentials of the command line are only sent
+// to the hosts given on the command line, the registry of the image and the
+// -mirror ones, their plain HTTP fallback included. The mirrors of the
+// registries config don't get them.
+func (req *RequestInfoManager) lookupCredentials(credentialHosts []string) error {
+	req.credentials = cli.Credentials{
+		UserName: req.imageInfo.UserName(),
+		Password: req.imageInfo.Password(),
+	}
+	req.endpointCredentials = map[string]cli.Credentials{}
+	for _, endpoint := range req.registryEndpoints {
+		if slices.Contains(credentialHosts, endpoint.host()) && len(req.credentials.UserName) > 0 {
+			req.endpointCredentials[endpoint.url] = req.credentials
+			continue
+		}
+		var credentials cli.Credentials
+		var err error
+		if len(endpoint.credentialHelper) > 0 {
+			credentials, err = cli.LookupHelperCredentials(endpoint.credentialHelper, endpoint.host())
 		} else {
-			req.registryEndpoint = registryEndpoint
+			credentials, err = cli.LookupCredentials(endpoint.host())
+		}
+		if err != nil {
+			return err
 		}
+		req.endpointCredentials[endpoint.url] = credentials
 	}
 	return nil
 }
 
+// RegistryEndpoint is the first endpoint
 func (req *RequestInfoManager) RegistryEndpoint() string {
-	return req.registryEndpoint
+	if len(req.registryEndpoints) == 0 {
+		return ""
+	}
+	return req.registryEndpoints[0].url
+}
+
+// RepositoryURL is the repository in the API of the first endpoint,
+// the requests are built against it.
+func (req *RequestInfoManager) RepositoryURL() string {
+	if len(req.registryEndpoints) == 0 {
+		return ""
+	}
+	return req.registryEndpoints[0].repositoryURL()
+}
+
+// RegistryEndpoints are the mirrors in order, then the upstream registry
+func (req *RequestInfoManager) RegistryEndpoints() []registryEndpoint {
+	return req.registryEndpoints
+}
+
+// Credentials of the endpoint, the ones of the command line when unknown
+func (req *RequestInfoManager) Credentials(endpointURL string) cli.Credentials {
+	if credentials, ok := req.endpointCredentials[endpointURL]; ok {
+		return credentials
+	}
+	return req.credentials
 }
 
 func (req *RequestInfoManager) Registry() (string, error) {
@@ -77,12 +197,9 @@ func (req *RequestInfoManager) Registry() (string, error) {
 	return req.imageInfo.Registry(), nil
 }
 
-func (req *RequestInfoManager) UserName() string {
-	return req.imageInfo.UserName()
-}
-
-func (req *RequestInfoManager) Password() string {
-	return req.imageInfo.Password()
+// RepositoryPath is the name of the repository in the registry API
+func (req *RequestInfoManager) RepositoryPath() string {
+	return req.imageInfo.Path()
 }
 
 func (req *RequestInfoManager) Repository() string {
@@ -97,6 +214,18 @@ func (req *RequestInfoManager) Tag() string {
 	return req.imageInfo.Tag()
 }
 
+func (req *RequestInfoManager) Digest() digest.Digest {
+	return req.imageInfo.Digest()
+}
+
+func (req *RequestInfoManager) Reference() string {
+	return req.imageInfo.Reference()
+}
+
 func (req *RequestInfoManager) Architecture() string {
 	return req.imageInfo.Architecture()
 }
+
+func (req *RequestInfoManager) Platform() string {
+	return req.imageInfo.Platform()
+}
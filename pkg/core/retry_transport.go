@@ -0,0 +1,207 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The longest wait between two attempts computed by the backoff
+const maxRetryBackoff = 30 * time.Second
+
+// A Retry-After longer than this is not waited, the response is returned
+const maxRetryAfter = 2 * time.Minute
+
+// RetryTransport retries the requests failed by a network error or
+// a transient status, waiting longer after each attempt.
+type RetryTransport struct {
+	Base http.RoundTripper
+	// The attempts of a request, the first one included
+	Attempts int
+	// The wait before the first retry, doubled after each attempt
+	Wait time.Duration
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.Base.RoundTrip(req)
+		if attempt >= t.Attempts || !retryableResponse(req, resp, err) {
+			return resp, err
+		}
+		// A body without GetBody can't be sent again
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+		wait := retryBackoff(t.Wait, attempt)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			if retryAfter, ok := parseRetryAfter(resp); ok {
+				if retryAfter > maxRetryAfter {
+					return resp, err
+				}
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		printf("Retrying %s %s in %s (%d/%d): %s\n",
+			req.Method, req.URL.Redacted(), wait.Round(time.Millisecond), attempt, t.Attempts-1, reason)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+type endpointFallbackKey struct{}
+
+// withEndpointFallback marks a request having another endpoint to try,
+// a timeout is not retried but falls back to the next endpoint.
+func withEndpointFallback(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), endpointFallbackKey{}, true))
+}
+
+type callerRetriesKey struct{}
+
+// withCallerRetries marks the requests whose network errors are retried by
+// the caller, like the layer downloads resuming a broken blob, so the
+// attempts of both don't multiply.
+func withCallerRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, callerRetriesKey{}, true)
+}
+
+// retryableResponse tells if the request may succeed when sent again
+func retryableResponse(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		if callerRetries, _ := req.Context().Value(callerRetriesKey{}).(bool); callerRetries {
+			return false
+		}
+		if fallback, _ := req.Context().Value(endpointFallbackKey{}).(bool); fallback && timeoutError(err) {
+			return false
+		}
+		return req.Context().Err() == nil && !permanentError(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		// The pull quota of Docker Hub comes back in hours, not in a few seconds
+		if _, ok := parseRetryAfter(resp); !ok {
+			if limit, ok := parseRateLimit(resp.Header); ok && limit.Remaining == 0 {
+				return false
+			}
+		}
+		return true
+	case http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryBackoff doubles the wait after each attempt, with a random jitter
+// so the parallel downloads don't retry all at once.
+func retryBackoff(wait time.Duration, attempt int) time.Duration {
+	backoff := wait
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// parseRetryAfter reads the Retry-After of a 429 or a 503,
+// either a number of seconds or a date.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := resp.Header.Get(HeaderRetryAfter)
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// permanentError tells if the request fails the same way when sent again,
+// like a TLS handshake with a plain HTTP server or an unknown host.
+func permanentError(err error) bool {
+	var recordHeaderErr tls.RecordHeaderError
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var dnsErr *net.DNSError
+	var registryTLSErr *registryTLSError
+	if errors.As(err, &registryTLSErr) {
+		return true
+	}
+	// A TLS alert of the server, like a missing client certificate
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return true
+	}
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+	return errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// timeoutError tells if the registry didn't answer in time
+func timeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// transientError tells if a download broken in the middle may be resumed
+func transientError(err error) bool {
+	if permanentError(err) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// schema1Manifest is the legacy docker manifest, the layers and
+// the history are listed from the top layer down to the base layer.
+type schema1Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Name          string `json:"name"`
+	Tag           string `json:"tag"`
+	Architecture  string `json:"architecture"`
+	FSLayers      []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// schema1History is the part of v1Compatibility kept in the image config history
+type schema1History struct {
+	Created         time.Time `json:"created"`
+	Author          string    `json:"author,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	ThrowAway       bool      `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
+
+func parseSchema1Manifest(body []byte) (*schema1Manifest, error) {
+	var manifest schema1Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.SchemaVersion != 1 {
+		return nil, fmt.Errorf("schema1 manifest: unexpected schema version %d", manifest.SchemaVersion)
+	}
+	if len(manifest.FSLayers) == 0 || len(manifest.FSLayers) != len(manifest.History) {
+		return nil, fmt.Errorf("schema1 manifest: %d layers for %d history entries",
+			len(manifest.FSLayers), len(manifest.History))
+	}
+	for _, layer := range manifest.FSLayers {
+		if err := layer.BlobSum.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &manifest, nil
+}
+
+// schema1Payload strips the signatures of a signed manifest,
+// the digest of a schema1 manifest is computed without them.
+func schema1Payload(body []byte) ([]byte, error) {
+	var signed struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(body, &signed); err != nil {
+		return nil, err
+	}
+	if len(signed.Signatures) == 0 {
+		return body, nil
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signed.Signatures[0].Protected, "="))
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, err
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.FormatTail, "="))
+	if err != nil {
+		return nil, err
+	}
+	if header.FormatLength <= 0 || header.FormatLength > len(body) {
+		return nil, fmt.Errorf("schema1 manifest: invalid signature format length %d", header.FormatLength)
+	}
+	payload := make([]byte, 0, header.FormatLength+len(tail))
+	payload = append(payload, body[:header.FormatLength]...)
+	return append(payload, tail...), nil
+}
+
+// manifestDigestContent returns the content the digest of a manifest is computed on
+func manifestDigestContent(mediaType string, body []byte) ([]byte, error) {
+	if mediaType == MediaTypeDockerSchema1SignedManifest {
+		return schema1Payload(body)
+	}
+	return body, nil
+}
+
+// BlobDigests returns the layers holding content, base layer first
+func (manifest *schema1Manifest) BlobDigests() ([]digest.Digest, error) {
+	var blobDigests []digest.Digest
+	for i := len(manifest.History) - 1; i >= 0; i-- {
+		var history schema1History
+		if err := json.Unmarshal([]byte(manifest.History[i].V1Compatibility), &history); err != nil {
+			return nil, err
+		}
+		if history.ThrowAway {
+			continue
+		}
+		blobDigests = append(blobDigests, manifest.FSLayers[i].BlobSum)
+	}
+	return blobDigests, nil
+}
+
+// ImageConfig rebuilds the image config from the v1Compatibility of the top
+// layer, the fields of the v1 image format are dropped.
+func (manifest *schema1Manifest) ImageConfig(diffIDs []digest.Digest) ([]byte, error) {
+	var config map[string]*json.RawMessage
+	if err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &config); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway"} {
+		delete(config, key)
+	}
+	histories := []v1.History{}
+	for i := len(manifest.History) - 1; i >= 0; i-- {
+		var history schema1History
+		if err := json.Unmarshal([]byte(manifest.History[i].V1Compatibility), &history); err != nil {
+			return nil, err
+		}
+		created := history.Created
+		histories = append(histories, v1.History{
+			Created:    &created,
+			CreatedBy:  strings.Join(history.ContainerConfig.Cmd, " "),
+			Author:     history.Author,
+			Comment:    history.Comment,
+			EmptyLayer: history.ThrowAway,
+		})
+	}
+	rootFS := v1.RootFS{
+		Type:    "layers",
+		DiffIDs: diffIDs,
+	}
+	for key, value := range map[string]any{"rootfs": rootFS, "history": histories} {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		message := json.RawMessage(raw)
+		config[key] = &message
+	}
+	return json.Marshal(config)
+}
+
+type byteCounter int64
+
+func (counter *byteCounter) Write(p []byte) (int, error) {
+	*counter += byteCounter(len(p))
+	return len(p), nil
+}
+
+// convertSchema1 reads every layer to compute the diff IDs schema1 doesn't have.
+// The layers are kept in the blob cache, or in a scratch directory without
+// the cache, so they are only downloaded once.
+func (blob *ImageConfigBlobFetcher) convertSchema1(manifest *schema1Manifest) ([]byte, error) {
+	if blob.outputFileInfo.Format() == FormatOCI {
+		return nil, fmt.Errorf("schema1 image can only be saved in the docker format")
+	}
+	if err := blob.blobCache.UseScratchDir(); err != nil {
+		return nil, err
+	}
+	fmt.Println("Converting schema1 manifest, computing the layer diff IDs")
+	imageConfig := blob.imageConfig
+	client := blob.httpClientCreate()
+	blobDigests := imageConfig.BlobDigests()
+	diffIDs := make([]digest.Digest, len(blobDigests))
+	computed := map[digest.Digest]digest.Digest{}
+	for i, blobDigest := range blobDigests {
+		if diffID, ok := computed[blobDigest]; ok {
+			diffIDs[i] = diffID
+			continue
+		}
+		diffID, size, err := blob.schema1DiffID(client, blobDigest)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", blobDigest, err)
+		}
+		imageConfig.setBlobSize(blobDigest, size)
+		computed[blobDigest] = diffID
+		diffIDs[i] = diffID
+	}
+	config, err := manifest.ImageConfig(diffIDs)
+	if err != nil {
+		return nil, err
+	}
+	imageConfig.setConfigDescriptor(v1.Descriptor{
+		MediaType: MediaTypeDockerImageConfig,
+		Digest:    digest.FromBytes(config),
+		Size:      int64(len(config)),
+	})
+	return config, nil
+}
+
+func (blob *ImageConfigBlobFetcher) schema1DiffID(client *http.Client, blobDigest digest.Digest) (diffID digest.Digest, size int64, err error) {
+	var src io.Reader
+	cached, fromCache := blob.blobCache.Open(blobDigest)
+	if fromCache {
+		defer cached.Close()
+		src = cached
+	} else {
+		requestInfo := blob.requestInfo
+		blobURL := fmt.Sprintf("%s/blobs/%s",
+			requestInfo.RepositoryURL(),
+			blobDigest)
+		req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+		if err != nil {
+			return "", 0, err
+		}
+		resp, err := blob.authenticator.Do(client, req)
+		if err != nil {
+			return "", 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", 0, fmt.Errorf("get layer failed, %s", resp.Status)
+		}
+		src = resp.Body
+		if blob.blobCache.Enabled() {
+			cacheWriter, cacheErr := blob.blobCache.Create(blobDigest)
+			if cacheErr == nil {
+				defer func() {
+					if err != nil {
+						cacheWriter.Discard()
+						return
+					}
+					cacheWriter.Commit()
+				}()
+				src = io.TeeReader(src, cacheWriter)
+			}
+		}
+	}
+	var counter byteCounter
+	blobVerifier := blobDigest.Verifier()
+	diffIDDigester := digest.Canonical.Digester()
+	blobReader := io.TeeReader(src, io.MultiWriter(blobVerifier, &counter))
+	decompressErr := decompressLayer(diffIDDigester.Hash(), blobReader, MediaTypeDockerLayer)
+	if _, err := io.Copy(io.Discard, blobReader); err != nil {
+		return "", 0, err
+	}
+	if !blobVerifier.Verified() {
+		if fromCache {
+			cached.Close()
+			blob.blobCache.Remove(blobDigest)
+		}
+		return "", 0, fmt.Errorf("downloaded content does not match the manifest digest")
+	}
+	if decompressErr != nil {
+		return "", 0, decompressErr
+	}
+	return diffIDDigester.Digest(), int64(counter), nil
+}